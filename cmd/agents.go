@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"smithy/internal/meta"
+	"smithy/pkg/agent"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/google/subcommands"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// clusterAgentIds returns the agent ids recorded for a cluster, nil when they
+// aren't all known, e.g. for clusters deployed by older smithy releases
+func clusterAgentIds(ctx context.Context, nc *nats.Conn, clusterId string) []string {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil
+	}
+	smithyClustersDataBucket, err := js.KeyValue(ctx, meta.SmithyClustersDataBucketName)
+	if err != nil {
+		return nil
+	}
+	record, err := getClusterRecord(ctx, smithyClustersDataBucket, clusterId)
+	if err != nil {
+		return nil
+	}
+	agentIds := []string{}
+	for _, ci := range record.ComputeInstances {
+		if ci.AgentId == "" {
+			return nil
+		}
+		agentIds = append(agentIds, ci.AgentId)
+	}
+	return agentIds
+}
+
+// sendAgentCommand sends a command to the agents it targets, all agents of the
+// cluster by default, and gathers their replies. It also returns the agents that
+// were expected to reply, nil if they aren't known.
+func sendAgentCommand(ctx context.Context, nc *nats.Conn, clusterId string, command *agent.Command) ([]*agent.Reply, []string, error) {
+	expected := command.Targets
+	if len(expected) == 0 {
+		// without the agent ids replies are gathered until ctx is done
+		expected = clusterAgentIds(ctx, nc, clusterId)
+	}
+	replies, err := agent.Send(ctx, nc, clusterId, command, expected)
+	return replies, expected, err
+}
+
+// describePid formats the data of start, restart and reload replies
+func describePid(action string) func(*agent.Reply) string {
+	return func(reply *agent.Reply) string {
+		data := &agent.StartData{}
+		if err := json.Unmarshal(reply.Data, data); err != nil || data.Pid == 0 {
+			return action + " nats-server"
+		}
+		return fmt.Sprintf("%s nats-server in process %d", action, data.Pid)
+	}
+}
+
+// reportReplies prints one line per agent, describe formats the data of successful
+// replies. It fails unless every agent replied successfully.
+func reportReplies(replies []*agent.Reply, expected []string, describe func(*agent.Reply) string) subcommands.ExitStatus {
+	status := subcommands.ExitSuccess
+
+	sort.Slice(replies, func(i, j int) bool {
+		return replies[i].AgentId < replies[j].AgentId
+	})
+	replied := map[string]bool{}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, reply := range replies {
+		replied[reply.AgentId] = true
+		if !reply.Ok {
+			fmt.Fprintf(w, "%s\terror\t%s\n", reply.AgentId, reply.Error)
+			status = subcommands.ExitFailure
+			continue
+		}
+		fmt.Fprintf(w, "%s\tok\t%s\n", reply.AgentId, describe(reply))
+	}
+	for _, agentId := range expected {
+		if !replied[agentId] {
+			fmt.Fprintf(w, "%s\tno reply\t\n", agentId)
+			status = subcommands.ExitFailure
+		}
+	}
+	w.Flush()
+
+	if len(replies) == 0 && len(expected) == 0 {
+		fmt.Println("no agent replied")
+		status = subcommands.ExitFailure
+	}
+	return status
+}
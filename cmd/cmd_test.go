@@ -0,0 +1,808 @@
+package cmd_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"smithy/cmd"
+	"smithy/internal/harness"
+	"smithy/pkg/agent"
+	"smithy/pkg/cloud"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestMain(m *testing.M) {
+	// the local provider runs its agents as `<executable> start-agent ...`, the
+	// test binary stands in for smithy then
+	if len(os.Args) > 1 && os.Args[1] == "start-agent" {
+		os.Exit(cmd.Run(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+func newHarness(t *testing.T) *harness.Harness {
+	t.Helper()
+	h, err := harness.New()
+	if err != nil {
+		t.Fatalf("unable to start harness: %v", err)
+	}
+	t.Cleanup(h.Close)
+	// the provider outlives the embedded server
+	harness.Fake.Reset()
+	return h
+}
+
+func run(t *testing.T, h *harness.Harness, args ...string) (int, string) {
+	t.Helper()
+	rc, output, err := h.RunOutput(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rc, output
+}
+
+// fakeInstances returns the fake provider's instances of a cluster
+func fakeInstances(clusterId string) []cloud.ComputeInstance {
+	instances := []cloud.ComputeInstance{}
+	for _, ci := range harness.Fake.Instances() {
+		if strings.HasPrefix(ci.AgentId, clusterId+"-node-") {
+			instances = append(instances, ci)
+		}
+	}
+	return instances
+}
+
+// respond answers the commands sent to a cluster's agents like agents would,
+// reply decides what each agent replies
+func respond(t *testing.T, h *harness.Harness, clusterId string, agentIds []string, reply func(agentId string, command *agent.Command) *agent.Reply) {
+	t.Helper()
+	sub, err := h.Conn().Subscribe(agent.CommandSubject(clusterId), func(msg *nats.Msg) {
+		command := &agent.Command{}
+		if err := json.Unmarshal(msg.Data, command); err != nil {
+			return
+		}
+		for _, agentId := range agentIds {
+			r := reply(agentId, command)
+			r.RequestId, r.AgentId = command.RequestId, agentId
+			data, _ := json.Marshal(r)
+			h.Conn().Publish(msg.Reply, data)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Conn().Flush(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Unsubscribe() })
+}
+
+func TestDeployListGetInfoTeardown(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t)
+
+	if rc := h.Deploy("a", 3); rc != 0 {
+		t.Fatalf("deploy-agents exited with %d", rc)
+	}
+
+	ac, err := h.AgentCluster(ctx, "a")
+	if err != nil {
+		t.Fatalf("unable to load cluster record: %v", err)
+	}
+	if ac.Provider != harness.FakeProviderName || ac.Status != cloud.StatusRunning || ac.SchemaVersion != cloud.AgentClusterSchemaVersion {
+		t.Errorf("unexpected cluster record %+v", ac)
+	}
+	if len(ac.ComputeInstances) != 3 {
+		t.Fatalf("expected 3 compute instances, got %d", len(ac.ComputeInstances))
+	}
+	if instances := fakeInstances("a"); len(instances) != 3 {
+		t.Errorf("expected the provider to run 3 instances, got %d", len(instances))
+	}
+	if _, ok := harness.Fake.SecurityGroups()[ac.SecurityGroupName]; !ok {
+		t.Errorf("security group %s was not created", ac.SecurityGroupName)
+	}
+
+	config, err := h.Object(agent.ConfigObjectName("a"))
+	if err != nil {
+		t.Fatalf("unable to get server config: %v", err)
+	}
+	for _, ci := range ac.ComputeInstances {
+		if !strings.Contains(string(config), ci.RouteUrl()) {
+			t.Errorf("server config has no route to %s", ci.RouteUrl())
+		}
+	}
+
+	// the cluster id is taken
+	if rc := h.Deploy("a", 1); rc == 0 {
+		t.Errorf("expected deploying an existing cluster to fail")
+	}
+
+	rc, output := run(t, h, "list")
+	if rc != 0 || !strings.Contains(output, "a") || !strings.Contains(output, string(cloud.StatusRunning)) {
+		t.Errorf("list exited with %d: %s", rc, output)
+	}
+
+	rc, output = run(t, h, "get-info", "-id", "a")
+	if rc != 0 {
+		t.Fatalf("get-info exited with %d", rc)
+	}
+	info, err := cloud.LoadAgentCluster([]byte(output))
+	if err != nil || len(info.ComputeInstances) != 3 {
+		t.Errorf("unexpected get-info output %s (%v)", output, err)
+	}
+
+	if rc = h.Run("teardown-agents", "-id", "a"); rc != 0 {
+		t.Fatalf("teardown-agents exited with %d", rc)
+	}
+	if clusterIds, err := h.ClusterIds(ctx); err != nil || len(clusterIds) != 0 {
+		t.Errorf("expected no keys left in the bucket, got %v (%v)", clusterIds, err)
+	}
+	if _, err = h.Object(agent.ConfigObjectName("a")); !errors.Is(err, nats.ErrObjectNotFound) {
+		t.Errorf("expected the server config to be deleted, got %v", err)
+	}
+	if instances := fakeInstances("a"); len(instances) != 0 {
+		t.Errorf("expected no instances left, got %d", len(instances))
+	}
+	if _, ok := harness.Fake.SecurityGroups()[ac.SecurityGroupName]; ok {
+		t.Errorf("security group %s was not deleted", ac.SecurityGroupName)
+	}
+}
+
+func TestLocalProvider(t *testing.T) {
+	ctx := context.Background()
+	if _, err := exec.LookPath("nats-server"); err != nil {
+		t.Skip("nats-server is not installed")
+	}
+	// the provider keeps its clusters in the temp dir
+	t.Setenv("TMPDIR", t.TempDir())
+	h := newHarness(t)
+
+	rc, output := run(t, h, "deploy-agents", "-provider", "local", "-id", "loc", "-n", "3")
+	if rc != 0 {
+		t.Fatalf("deploy-agents exited with %d: %s", rc, output)
+	}
+	t.Cleanup(func() { h.Run("teardown-agents", "-id", "loc") })
+	ac, err := h.AgentCluster(ctx, "loc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ac.Provider != "local" || len(ac.ComputeInstances) != 3 {
+		t.Fatalf("unexpected cluster record %+v", ac)
+	}
+
+	rc, output = run(t, h, "start-nats", "-id", "loc", "-wait", "-wait-timeout", "1m")
+	if rc != 0 {
+		t.Fatalf("start-nats exited with %d: %s", rc, output)
+	}
+	for _, ci := range ac.ComputeInstances {
+		if !strings.Contains(output, ci.ClientUrl()) {
+			t.Errorf("start-nats didn't report %s: %s", ci.ClientUrl(), output)
+		}
+	}
+
+	if rc = h.Run("teardown-agents", "-id", "loc"); rc != 0 {
+		t.Fatalf("teardown-agents exited with %d", rc)
+	}
+	for _, ci := range ac.ComputeInstances {
+		if err = syscall.Kill(ci.Pid, 0); err == nil {
+			t.Errorf("agent %s still runs as process %d", ci.AgentId, ci.Pid)
+		}
+	}
+	if _, err = os.Stat(ac.SecurityGroupId); !os.IsNotExist(err) {
+		t.Errorf("expected cluster directory %s to be removed, got %v", ac.SecurityGroupId, err)
+	}
+	if _, err = h.AgentCluster(ctx, "loc"); !errors.Is(err, jetstream.ErrKeyNotFound) {
+		t.Errorf("expected the cluster record to be removed, got %v", err)
+	}
+}
+
+func TestExecAllow(t *testing.T) {
+	ctx := context.Background()
+	if _, err := exec.LookPath("nats-server"); err != nil {
+		t.Skip("nats-server is not installed")
+	}
+	t.Setenv("TMPDIR", t.TempDir())
+	h := newHarness(t)
+
+	rc, output := run(t, h, "deploy-agents", "-provider", "local", "-id", "ex", "-n", "1", "-exec-allow", "echo, true")
+	if rc != 0 {
+		t.Fatalf("deploy-agents exited with %d: %s", rc, output)
+	}
+	t.Cleanup(func() { h.Run("teardown-agents", "-id", "ex") })
+	rc, output = run(t, h, "deploy-agents", "-provider", "local", "-id", "nx", "-n", "1")
+	if rc != 0 {
+		t.Fatalf("deploy-agents exited with %d: %s", rc, output)
+	}
+	t.Cleanup(func() { h.Run("teardown-agents", "-id", "nx") })
+
+	ac, err := h.AgentCluster(ctx, "ex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ac.ExecAllow, ",") != "echo,true" {
+		t.Errorf("expected the cluster to record the allowed programs, got %v", ac.ExecAllow)
+	}
+
+	// the agents subscribe once they are connected, which may take a moment
+	execUntilReplied := func(args ...string) (int, string) {
+		t.Helper()
+		deadline := time.Now().Add(15 * time.Second)
+		for {
+			rc, output := run(t, h, append([]string{"exec", "-t", "2s"}, args...)...)
+			if !strings.Contains(output, "no reply") || time.Now().After(deadline) {
+				return rc, output
+			}
+		}
+	}
+
+	// only the program is checked, its arguments are up to the caller
+	rc, output = execUntilReplied("-id", "ex", "--", "echo", "hello", "smithy")
+	if rc != 0 || !strings.Contains(output, "hello smithy") {
+		t.Errorf("expected echo to run on ex-node-0, got %d: %s", rc, output)
+	}
+	rc, output = execUntilReplied("-id", "ex", "--", "uname")
+	if rc == 0 || !strings.Contains(output, "uname is not allowed") {
+		t.Errorf("expected uname to be rejected, got %d: %s", rc, output)
+	}
+	rc, output = execUntilReplied("-id", "nx", "--", "echo", "hello")
+	if rc == 0 || !strings.Contains(output, "exec is disabled") {
+		t.Errorf("expected exec to be disabled without -exec-allow, got %d: %s", rc, output)
+	}
+}
+
+func TestDeployConfigTemplate(t *testing.T) {
+	h := newHarness(t)
+
+	templatePath := filepath.Join(t.TempDir(), "server.conf.tmpl")
+	content := "port: 4222\n# {{ .Node.AgentId }}\n"
+	if err := os.WriteFile(templatePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rc := h.Deploy("t", 2, "-config-template", templatePath); rc != 0 {
+		t.Fatalf("deploy-agents exited with %d", rc)
+	}
+
+	for _, agentId := range []string{"t-node-0", "t-node-1"} {
+		config, err := h.Object(agent.NodeConfigObjectName("t", agentId))
+		if err != nil {
+			t.Fatalf("no config for %s: %v", agentId, err)
+		}
+		if !strings.Contains(string(config), "# "+agentId) {
+			t.Errorf("config of %s wasn't rendered for it: %s", agentId, config)
+		}
+	}
+	// agents that can't fetch their own config fall back to the first node's
+	config, err := h.Object(agent.ConfigObjectName("t"))
+	if err != nil {
+		t.Fatalf("no shared config: %v", err)
+	}
+	if !strings.Contains(string(config), "# t-node-0") {
+		t.Errorf("shared config wasn't rendered for the first node: %s", config)
+	}
+}
+
+func TestDeployConfigTemplatePorts(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t)
+
+	// the aws security group only opens the default ports
+	templatePath := filepath.Join(t.TempDir(), "server.conf.tmpl")
+	content := "port: 4333\ncluster {\n  port: 6222\n}\n"
+	if err := os.WriteFile(templatePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rc := h.Run("deploy-agents", "-provider", "aws", "-id", "p", "-config-template", templatePath); rc != int(subcommands.ExitUsageError) {
+		t.Fatalf("expected deploy-agents to reject the ports with a usage error, got %d", rc)
+	}
+	if _, err := h.AgentCluster(ctx, "p"); !errors.Is(err, jetstream.ErrKeyNotFound) {
+		t.Errorf("expected no cluster record, got %v", err)
+	}
+	// providers that don't firewall their nodes take any port
+	if rc := h.Deploy("p", 1, "-config-template", templatePath); rc != 0 {
+		t.Fatalf("deploy-agents exited with %d", rc)
+	}
+}
+
+func TestDeployRollback(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t)
+
+	harness.Fake.InjectError("CreateComputeInstances", errors.New("no capacity"))
+	if rc := h.Deploy("r", 2); rc == 0 {
+		t.Fatalf("expected deploy-agents to fail")
+	}
+	if _, err := h.AgentCluster(ctx, "r"); !errors.Is(err, jetstream.ErrKeyNotFound) {
+		t.Errorf("expected the cluster record to be removed, got %v", err)
+	}
+	if _, ok := harness.Fake.SecurityGroups()["smithy-sg-r"]; ok {
+		t.Errorf("security group of the failed deploy was not deleted")
+	}
+}
+
+func TestStartNats(t *testing.T) {
+	h := newHarness(t)
+
+	if rc := h.Deploy("s", 2); rc != 0 {
+		t.Fatalf("deploy-agents exited with %d", rc)
+	}
+	commands := make(chan *agent.Command, 10)
+	respond(t, h, "s", []string{"s-node-0", "s-node-1"}, func(agentId string, command *agent.Command) *agent.Reply {
+		if agentId == "s-node-0" {
+			commands <- command
+		}
+		data, _ := json.Marshal(&agent.StartData{Pid: 42})
+		return &agent.Reply{Ok: true, Data: data}
+	})
+
+	rc, output := run(t, h, "start-nats", "-id", "s", "-t", "5s")
+	if rc != 0 {
+		t.Fatalf("start-nats exited with %d: %s", rc, output)
+	}
+	if command := <-commands; command.Command != agent.CommandStart {
+		t.Errorf("expected a start command, got %s", command.Command)
+	}
+	for _, agentId := range []string{"s-node-0", "s-node-1"} {
+		if !strings.Contains(output, agentId) {
+			t.Errorf("start-nats didn't report %s: %s", agentId, output)
+		}
+	}
+
+	// unknown agents are a usage error
+	if rc = h.Run("start-nats", "-id", "s", "-agents", "s-node-7"); rc == 0 {
+		t.Errorf("expected start-nats to reject unknown agents")
+	}
+	if rc = h.Run("start-nats", "-id", "nope", "-t", "1s"); rc == 0 {
+		t.Errorf("expected start-nats to fail for a cluster that doesn't exist")
+	}
+}
+
+func TestStartNatsFailure(t *testing.T) {
+	h := newHarness(t)
+
+	if rc := h.Deploy("f", 2); rc != 0 {
+		t.Fatalf("deploy-agents exited with %d", rc)
+	}
+	// only one agent replies, with an error
+	respond(t, h, "f", []string{"f-node-0"}, func(agentId string, command *agent.Command) *agent.Reply {
+		return &agent.Reply{Error: "nats-server is already running"}
+	})
+
+	rc, output := run(t, h, "start-nats", "-id", "f", "-t", "1s")
+	if rc == 0 {
+		t.Fatalf("expected start-nats to fail: %s", output)
+	}
+	if !strings.Contains(output, "already running") || !strings.Contains(output, "no reply") {
+		t.Errorf("start-nats didn't report the failures: %s", output)
+	}
+}
+
+func TestStartNatsWait(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t)
+
+	if rc := h.Deploy("w", 2); rc != 0 {
+		t.Fatalf("deploy-agents exited with %d", rc)
+	}
+	js, err := jetstream.New(h.Conn())
+	if err != nil {
+		t.Fatal(err)
+	}
+	heartbeats, err := agent.HeartbeatBucket(ctx, js, "w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the agents' clocks are off by a day, only the order of the heartbeats counts
+	report := func(agentId string) error {
+		heartbeat := &agent.Heartbeat{
+			AgentId:     agentId,
+			Time:        time.Now().Add(-24 * time.Hour),
+			ServerState: agent.ServerRunning,
+			Health:      &agent.ServerHealth{Ready: true, Routes: 1, JetStream: true, MetaLeader: "w-node-0"},
+		}
+		data, _ := json.Marshal(heartbeat)
+		_, err := heartbeats.Put(ctx, agentId, data)
+		return err
+	}
+
+	// ready heartbeats from before the start don't count
+	for _, agentId := range []string{"w-node-0", "w-node-1"} {
+		if err = report(agentId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// agents report after starting unless quiet, the failing one can't start
+	var quiet atomic.Bool
+	var failing atomic.Value
+	quiet.Store(true)
+	failing.Store("")
+	respond(t, h, "w", []string{"w-node-0", "w-node-1"}, func(agentId string, command *agent.Command) *agent.Reply {
+		if !quiet.Load() {
+			if err := report(agentId); err != nil {
+				t.Error(err)
+			}
+		}
+		if agentId == failing.Load() {
+			return &agent.Reply{Error: "nats-server is already running"}
+		}
+		return &agent.Reply{Ok: true}
+	})
+	rc, output := run(t, h, "start-nats", "-id", "w", "-t", "1s", "-wait", "-wait-timeout", "1s")
+	if rc == 0 || !strings.Contains(output, "no heartbeat since start") {
+		t.Fatalf("expected start-nats to wait for fresh heartbeats: %s", output)
+	}
+
+	// the cluster forms after the start, whatever the agents' clocks say
+	quiet.Store(false)
+	rc, output = run(t, h, "start-nats", "-id", "w", "-t", "5s", "-wait", "-wait-timeout", "10s")
+	if rc != 0 {
+		t.Fatalf("start-nats exited with %d: %s", rc, output)
+	}
+	if !strings.Contains(output, "nats urls") {
+		t.Errorf("start-nats didn't report the urls: %s", output)
+	}
+
+	// a formed cluster doesn't hide the agents that failed to start
+	failing.Store("w-node-1")
+	rc, output = run(t, h, "start-nats", "-id", "w", "-t", "5s", "-wait", "-wait-timeout", "10s")
+	if rc == 0 || !strings.Contains(output, "already running") || !strings.Contains(output, "nats urls") {
+		t.Errorf("expected start-nats to report the failed agent of the formed cluster: %s", output)
+	}
+}
+
+func TestStartNatsLegacy(t *testing.T) {
+	h := newHarness(t)
+
+	if rc := h.Deploy("o", 1); rc != 0 {
+		t.Fatalf("deploy-agents exited with %d", rc)
+	}
+	// agents of older releases ignore the json command and never reply
+	legacy := make(chan string, 10)
+	sub, err := h.Conn().Subscribe(agent.CommandSubject("o"), func(msg *nats.Msg) {
+		if string(msg.Data) == agent.CommandStart {
+			legacy <- string(msg.Data)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	rc, output := run(t, h, "start-nats", "-id", "o", "-t", "1s")
+	if rc != 0 {
+		t.Errorf("expected the legacy start to succeed: %s", output)
+	}
+	if strings.Contains(output, "no reply") {
+		t.Errorf("expected no per agent errors for the legacy start: %s", output)
+	}
+	select {
+	case <-legacy:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("start-nats didn't send the legacy start: %s", output)
+	}
+	if !strings.Contains(output, "legacy start") {
+		t.Errorf("start-nats didn't report the legacy start: %s", output)
+	}
+}
+
+func TestControlNats(t *testing.T) {
+	h := newHarness(t)
+
+	if rc := h.Deploy("c", 2); rc != 0 {
+		t.Fatalf("deploy-agents exited with %d", rc)
+	}
+	commands := make(chan *agent.Command, 10)
+	respond(t, h, "c", []string{"c-node-0", "c-node-1"}, func(agentId string, command *agent.Command) *agent.Reply {
+		if agentId == "c-node-0" {
+			commands <- command
+		}
+		data, _ := json.Marshal(&agent.StartData{Pid: 42})
+		return &agent.Reply{Ok: true, Data: data}
+	})
+
+	rc, output := run(t, h, "stop-nats", "-id", "c", "-t", "5s")
+	if rc != 0 {
+		t.Fatalf("stop-nats exited with %d: %s", rc, output)
+	}
+	if command := <-commands; command.Command != agent.CommandStop {
+		t.Errorf("expected a stop command, got %s", command.Command)
+	}
+	// -cluster is still understood
+	if rc, output = run(t, h, "restart-nats", "-cluster", "c", "-t", "5s"); rc != 0 {
+		t.Fatalf("restart-nats exited with %d: %s", rc, output)
+	}
+	if command := <-commands; command.Command != agent.CommandRestart {
+		t.Errorf("expected a restart command, got %s", command.Command)
+	}
+
+	// clusters that don't exist fail without waiting for replies
+	started := time.Now()
+	rc, output = run(t, h, "reload-nats", "-id", "nope", "-t", "1m")
+	if rc == 0 || !strings.Contains(output, "does not exist") {
+		t.Errorf("expected reload-nats to fail for a cluster that doesn't exist: %s", output)
+	}
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("reload-nats waited %s for a cluster that doesn't exist", elapsed)
+	}
+}
+
+func TestLeaseConflict(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t)
+	bucket, err := h.Bucket(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rc := h.Deploy("l", 1); rc != 0 {
+		t.Fatalf("deploy-agents exited with %d", rc)
+	}
+	// somebody else is tearing the cluster down
+	lease := cloud.NewLease(cloud.OperationTeardown, time.Hour)
+	lease.Holder = "alice@laptop"
+	if _, err = bucket.Put(ctx, "_lease.l", lease.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if rc := h.Run("teardown-agents", "-id", "l"); rc == 0 {
+		t.Fatalf("expected teardown-agents to fail while the cluster is leased")
+	}
+	if _, err = h.AgentCluster(ctx, "l"); err != nil {
+		t.Errorf("expected the cluster record to be kept, got %v", err)
+	}
+	if instances := fakeInstances("l"); len(instances) != 1 {
+		t.Errorf("expected the instance to be kept, got %d", len(instances))
+	}
+	rc, output := run(t, h, "list")
+	if rc != 0 || !strings.Contains(output, "being torn down by alice@laptop") {
+		t.Errorf("list doesn't show the lease: %s", output)
+	}
+
+	// an expired lease is taken over
+	lease.ExpiresAt = time.Now().Add(-time.Minute)
+	if _, err = bucket.Put(ctx, "_lease.l", lease.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if rc := h.Run("teardown-agents", "-id", "l"); rc != 0 {
+		t.Fatalf("teardown-agents exited with %d", rc)
+	}
+	if _, err = h.AgentCluster(ctx, "l"); !errors.Is(err, jetstream.ErrKeyNotFound) {
+		t.Errorf("expected the cluster record to be removed, got %v", err)
+	}
+
+	// tearing down a cluster that doesn't exist leaves no lease behind
+	if rc := h.Run("teardown-agents", "-id", "nope"); rc == 0 {
+		t.Errorf("expected teardown-agents to fail for a cluster that doesn't exist")
+	}
+	if _, err = bucket.Get(ctx, "_lease.nope"); !errors.Is(err, jetstream.ErrKeyNotFound) {
+		t.Errorf("expected no lease for cluster nope, got %v", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t)
+	bucket, err := h.Bucket(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// written by a smithy release without schema versions
+	legacy := `{"security_group_name":"smithy-sg-m","security_group_id":"sg-1","compute_instances":[{"dns_name":"m0","instance_id":"i-1","private_ip":"10.0.0.1","public_ip":"192.0.2.1"}]}`
+	if _, err = bucket.Put(ctx, "m", []byte(legacy)); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, output := run(t, h, "migrate", "-dry-run")
+	if rc != 0 || !strings.Contains(output, "m would be migrated from schema version 0") {
+		t.Errorf("migrate -dry-run exited with %d: %s", rc, output)
+	}
+	if entry, err := bucket.Get(ctx, "m"); err != nil || string(entry.Value()) != legacy {
+		t.Fatalf("migrate -dry-run changed the record (%v)", err)
+	}
+
+	if rc = h.Run("migrate"); rc != 0 {
+		t.Fatalf("migrate exited with %d", rc)
+	}
+	entry, err := bucket.Get(ctx, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := map[string]interface{}{}
+	if err = json.Unmarshal(entry.Value(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["schema_version"] != float64(cloud.AgentClusterSchemaVersion) || record["provider"] != cloud.DefaultProvider || record["status"] != string(cloud.StatusRunning) {
+		t.Errorf("unexpected migrated record %s", entry.Value())
+	}
+
+	rc, output = run(t, h, "migrate")
+	if rc != 0 || !strings.Contains(output, "m is up to date") {
+		t.Errorf("migrate exited with %d: %s", rc, output)
+	}
+}
+
+func TestGc(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t)
+	bucket, err := h.Bucket(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a cluster that is fine
+	if rc := h.Deploy("live", 1); rc != 0 {
+		t.Fatalf("deploy-agents exited with %d", rc)
+	}
+
+	// resources of a deploy that died half-way
+	orphanGroupId, err := harness.Fake.CreateSecurityGroup(ctx, "smithy-sg-orphan", "orphan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphans, err := harness.Fake.CreateComputeInstances(ctx, "smithy-sg-orphan", "smithy-compute-node-orphan", 2, "", "orphan")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an entry whose resources are gone, with its config
+	stale := &cloud.AgentCluster{
+		Provider:          harness.FakeProviderName,
+		SecurityGroupName: "smithy-sg-gone",
+		SecurityGroupId:   "fake-sg-gone",
+		ComputeInstances:  []cloud.ComputeInstance{{InstanceId: "fake-i-gone", AgentId: "gone-node-0"}},
+	}
+	stale.SetStatus(cloud.StatusRunning, nil)
+	if _, err = bucket.Put(ctx, "gone", stale.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = h.ObjectStore().PutBytes(agent.ConfigObjectName("gone"), []byte("port: 4222")); err != nil {
+		t.Fatal(err)
+	}
+	// a per node config nothing owns
+	if _, err = h.ObjectStore().PutBytes(agent.NodeConfigObjectName("nobody", "nobody-node-0"), []byte("port: 4222")); err != nil {
+		t.Fatal(err)
+	}
+
+	// left behind by a collect that died, it holds a copy of a server config
+	collectName := agent.CollectObjectName("req", "live-node-0", agent.ConfigObjectName("live"))
+	if _, err = h.ObjectStore().PutBytes(collectName, []byte("port: 4222")); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, output := run(t, h, "gc", "-provider", harness.FakeProviderName, "-min-age", "0s", "-yes")
+	if rc != 0 {
+		t.Fatalf("gc exited with %d: %s", rc, output)
+	}
+	if strings.Contains(output, "orphaned config "+collectName) {
+		t.Errorf("gc took a collect upload for a config: %s", output)
+	}
+	for _, expected := range []string{
+		"orphaned security-group " + orphanGroupId,
+		"orphaned instance " + orphans[0].InstanceId,
+		"stale cluster entry gone",
+		"orphaned config " + agent.ConfigObjectName("gone"),
+		"orphaned config " + agent.NodeConfigObjectName("nobody", "nobody-node-0"),
+		"stale collect upload " + collectName,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("gc didn't report %q: %s", expected, output)
+		}
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.Contains(line, "live") && !strings.Contains(line, collectName) {
+			t.Errorf("gc collected the live cluster: %s", line)
+		}
+	}
+
+	if instances := fakeInstances("orphan"); len(instances) != 0 {
+		t.Errorf("expected the orphaned instances to be terminated, got %d", len(instances))
+	}
+	if _, ok := harness.Fake.SecurityGroups()["smithy-sg-orphan"]; ok {
+		t.Errorf("expected the orphaned security group to be deleted")
+	}
+	if _, err = h.AgentCluster(ctx, "gone"); !errors.Is(err, jetstream.ErrKeyNotFound) {
+		t.Errorf("expected the stale entry to be deleted, got %v", err)
+	}
+	for _, name := range []string{agent.ConfigObjectName("gone"), agent.NodeConfigObjectName("nobody", "nobody-node-0"), collectName} {
+		if _, err = h.Object(name); !errors.Is(err, nats.ErrObjectNotFound) {
+			t.Errorf("expected %s to be deleted, got %v", name, err)
+		}
+	}
+
+	// the live cluster is untouched
+	if _, err = h.AgentCluster(ctx, "live"); err != nil {
+		t.Errorf("expected the live cluster to be kept, got %v", err)
+	}
+	if instances := fakeInstances("live"); len(instances) != 1 {
+		t.Errorf("expected the live instance to be kept, got %d", len(instances))
+	}
+	if _, err = h.Object(agent.ConfigObjectName("live")); err != nil {
+		t.Errorf("expected the live config to be kept, got %v", err)
+	}
+
+	rc, output = run(t, h, "gc", "-provider", harness.FakeProviderName, "-min-age", "0s", "-yes")
+	if rc != 0 || !strings.Contains(output, "nothing to collect") {
+		t.Errorf("expected nothing left to collect, gc exited with %d: %s", rc, output)
+	}
+}
+
+func TestStatusDegraded(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t)
+
+	if rc := h.Deploy("d", 2); rc != 0 {
+		t.Fatalf("deploy-agents exited with %d", rc)
+	}
+	js, err := jetstream.New(h.Conn())
+	if err != nil {
+		t.Fatal(err)
+	}
+	heartbeats, err := agent.HeartbeatBucket(ctx, js, "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := func(agentId string) {
+		heartbeat := &agent.Heartbeat{
+			AgentId:     agentId,
+			Time:        time.Now(),
+			ServerState: agent.ServerRunning,
+			Health:      &agent.ServerHealth{Ready: true},
+		}
+		data, _ := json.Marshal(heartbeat)
+		if _, err := heartbeats.Put(ctx, agentId, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// one agent never reported
+	report("d-node-0")
+	rc, output := run(t, h, "status", "-id", "d")
+	if rc != 0 {
+		t.Fatalf("status exited with %d: %s", rc, output)
+	}
+	ac, err := h.AgentCluster(ctx, "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ac.Status != cloud.StatusDegraded || !strings.Contains(ac.LastError, "d-node-1 never reported") {
+		t.Errorf("expected the cluster to be degraded by d-node-1, got %s (%s)", ac.Status, ac.LastError)
+	}
+
+	// all agents are healthy again, the record belongs to whoever holds the lease
+	report("d-node-1")
+	bucket, err := h.Bucket(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease := cloud.NewLease(cloud.OperationTeardown, time.Hour)
+	revision, err := bucket.Put(ctx, "_lease.d", lease.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc = h.Run("status", "-id", "d"); rc != 0 {
+		t.Fatalf("status exited with %d", rc)
+	}
+	if ac, err = h.AgentCluster(ctx, "d"); err != nil || ac.Status != cloud.StatusDegraded {
+		t.Errorf("expected status to leave the leased cluster degraded, got %+v (%v)", ac, err)
+	}
+	if err = bucket.Delete(ctx, "_lease.d", jetstream.LastRevision(revision)); err != nil {
+		t.Fatal(err)
+	}
+	if rc = h.Run("status", "-id", "d"); rc != 0 {
+		t.Fatalf("status exited with %d", rc)
+	}
+	if ac, err = h.AgentCluster(ctx, "d"); err != nil || ac.Status != cloud.StatusRunning {
+		t.Errorf("expected the cluster to be running again, got %+v (%v)", ac, err)
+	}
+}
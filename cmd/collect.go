@@ -0,0 +1,239 @@
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"smithy/internal/meta"
+	"smithy/pkg/agent"
+	"sort"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/nats-io/nats.go"
+)
+
+type collectCmd struct {
+	metaCommand
+	serverUrl string
+	credsPath string
+	clusterId string
+	agentId   string
+	output    string
+	logLines  int
+	timeout   time.Duration
+}
+
+func collectCommand() subcommands.Command {
+	return &collectCmd{
+		metaCommand: metaCommand{
+			name:     "collect",
+			synopsis: "gather nats-server diagnostics from every node of a cluster into a bundle",
+			usage:    "collect -id <string> -server <url> -creds </path/to/file> [-o <path/to/bundle.tar.gz>] [-agent <string>] [-log-lines <int>] [-t <duration>]",
+		},
+	}
+}
+
+func (cc *collectCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&cc.clusterId, "id", "default", "smithy cluster id")
+	f.StringVar(&cc.serverUrl, "server", nats.DefaultURL, "url of the command server")
+	f.StringVar(&cc.credsPath, "creds", "", "path to creds file")
+	f.StringVar(&cc.agentId, "agent", "", "only collect from this agent (default: all agents of the cluster)")
+	f.StringVar(&cc.output, "o", "", "bundle to write (default <id>-<time>.tar.gz)")
+	f.IntVar(&cc.logLines, "log-lines", 500, "how many of the last log lines to collect")
+	f.DurationVar(&cc.timeout, "t", time.Minute, "how long to wait for the agents to collect")
+}
+
+// collectManifest describes the bundle, every agent's files are in a directory
+// named after the agent
+type collectManifest struct {
+	ClusterId   string                           `json:"cluster_id"`
+	CollectedAt time.Time                        `json:"collected_at"`
+	Agents      map[string]*collectManifestEntry `json:"agents"`
+}
+
+type collectManifestEntry struct {
+	Files []string `json:"files,omitempty"`
+	// Errors are the artifacts that couldn't be collected, Error is set when
+	// nothing could be
+	Errors map[string]string `json:"errors,omitempty"`
+	Error  string            `json:"error,omitempty"`
+}
+
+func (cc *collectCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+
+	collectCtx, cancel := context.WithTimeout(ctx, cc.timeout)
+	defer cancel()
+
+	collectedAt := time.Now().UTC()
+	if cc.output == "" {
+		cc.output = fmt.Sprintf("%s-%s.tar.gz", cc.clusterId, collectedAt.Format("20060102-150405"))
+	}
+
+	nc, err := connect(cc.serverUrl, cc.credsPath)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	defer nc.Close()
+	jsObj, err := nc.JetStream()
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	obj, err := jsObj.ObjectStore(meta.SmithyClustersObjStoreName)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+
+	targets := []string{}
+	if cc.agentId != "" {
+		targets = append(targets, cc.agentId)
+	}
+	command, err := agent.NewCommand(agent.CommandCollect, targets, &agent.CollectArgs{LogLines: cc.logLines})
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	replies, expected, err := sendAgentCommand(collectCtx, nc, cc.clusterId, command)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+
+	manifest := &collectManifest{
+		ClusterId:   cc.clusterId,
+		CollectedAt: collectedAt,
+		Agents:      map[string]*collectManifestEntry{},
+	}
+	for _, agentId := range expected {
+		manifest.Agents[agentId] = &collectManifestEntry{Error: "no reply"}
+	}
+	if len(replies) == 0 {
+		log.Println("no agent replied")
+		return subcommands.ExitFailure
+	}
+
+	if err = cc.writeBundle(obj, replies, manifest); err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+
+	// the uploads are only needed until they are bundled
+	for _, reply := range replies {
+		data := &agent.CollectData{}
+		if json.Unmarshal(reply.Data, data) != nil {
+			continue
+		}
+		for _, objectName := range data.Files {
+			if err = obj.Delete(objectName); err != nil && err != nats.ErrObjectNotFound {
+				log.Printf("unable to delete %s, %v", objectName, err)
+			}
+		}
+	}
+
+	status := subcommands.ExitSuccess
+	agentIds := []string{}
+	for agentId := range manifest.Agents {
+		agentIds = append(agentIds, agentId)
+	}
+	sort.Strings(agentIds)
+	for _, agentId := range agentIds {
+		entry := manifest.Agents[agentId]
+		switch {
+		case entry.Error != "":
+			fmt.Printf("%s: %s\n", agentId, entry.Error)
+			status = subcommands.ExitFailure
+		case len(entry.Errors) > 0:
+			fmt.Printf("%s: %d files, %d could not be collected\n", agentId, len(entry.Files), len(entry.Errors))
+		default:
+			fmt.Printf("%s: %d files\n", agentId, len(entry.Files))
+		}
+	}
+	fmt.Printf("wrote %s\n", cc.output)
+
+	return status
+}
+
+// writeBundle downloads what the agents collected and packages it along with
+// the manifest
+func (cc *collectCmd) writeBundle(obj nats.ObjectStore, replies []*agent.Reply, manifest *collectManifest) error {
+	out, err := os.Create(cc.output)
+	if err != nil {
+		return fmt.Errorf("unable to create bundle, %v", err)
+	}
+	defer out.Close()
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+
+	add := func(name string, content []byte) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(content)),
+			ModTime: manifest.CollectedAt,
+		}); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+
+	for _, reply := range replies {
+		entry := &collectManifestEntry{}
+		manifest.Agents[reply.AgentId] = entry
+		if !reply.Ok {
+			entry.Error = reply.Error
+			continue
+		}
+		data := &agent.CollectData{}
+		if err = json.Unmarshal(reply.Data, data); err != nil {
+			entry.Error = fmt.Sprintf("unreadable reply, %v", err)
+			continue
+		}
+		entry.Errors = data.Errors
+
+		files := []string{}
+		for file := range data.Files {
+			files = append(files, file)
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			content, err := obj.GetBytes(data.Files[file])
+			if err != nil {
+				if entry.Errors == nil {
+					entry.Errors = map[string]string{}
+				}
+				entry.Errors[file] = fmt.Sprintf("unable to download, %v", err)
+				continue
+			}
+			name := path.Join(reply.AgentId, file)
+			if err = add(name, content); err != nil {
+				return fmt.Errorf("unable to write bundle, %v", err)
+			}
+			entry.Files = append(entry.Files, name)
+		}
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = add("manifest.json", append(manifestData, '\n')); err != nil {
+		return fmt.Errorf("unable to write bundle, %v", err)
+	}
+	if err = tw.Close(); err != nil {
+		return fmt.Errorf("unable to write bundle, %v", err)
+	}
+	if err = gz.Close(); err != nil {
+		return fmt.Errorf("unable to write bundle, %v", err)
+	}
+	return out.Close()
+}
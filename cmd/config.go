@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"smithy/pkg/cloud"
+	"strings"
+	"text/template"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// serverConfigData is what server config templates are rendered with
+type serverConfigData struct {
+	// ClusterName is the smithy cluster id
+	ClusterName string
+	// Nodes are all nodes of the cluster, Node is the one the config is for and
+	// NodeIndex its index in Nodes
+	Nodes     []serverConfigNode
+	Node      serverConfigNode
+	NodeIndex int
+	// MonitorPort is the http monitoring port given to deploy-agents
+	MonitorPort int
+	// ClusterRoutesString lists the route urls of all nodes, one per line
+	ClusterRoutesString string
+}
+
+// serverConfigNode describes a node, ports are the ones its nats-server listens on
+type serverConfigNode struct {
+	Index       int
+	AgentId     string
+	DnsName     string
+	PrivateIp   string
+	PublicIp    string
+	ClientPort  int
+	ClusterPort int
+	MonitorPort int
+	ClientUrl   string
+	RouteUrl    string
+}
+
+// newServerConfigData describes a cluster for the config of the node at nodeIndex
+func newServerConfigData(clusterId string, computeInstances []cloud.ComputeInstance, nodeIndex int, monitorPort int) *serverConfigData {
+	data := &serverConfigData{
+		ClusterName: clusterId,
+		NodeIndex:   nodeIndex,
+		MonitorPort: monitorPort,
+	}
+	for i, ci := range computeInstances {
+		node := serverConfigNode{
+			Index:       i,
+			AgentId:     ci.AgentId,
+			DnsName:     ci.DnsName,
+			PrivateIp:   ci.PrivateIp,
+			PublicIp:    ci.PublicIp,
+			ClientPort:  ci.ClientPort,
+			ClusterPort: ci.ClusterPort,
+			MonitorPort: ci.MonitorPort,
+			ClientUrl:   ci.ClientUrl(),
+			RouteUrl:    ci.RouteUrl(),
+		}
+		if node.ClientPort == 0 {
+			node.ClientPort = cloud.DefaultClientPort
+		}
+		if node.ClusterPort == 0 {
+			node.ClusterPort = cloud.DefaultClusterPort
+		}
+		if node.MonitorPort == 0 {
+			node.MonitorPort = monitorPort
+		}
+		data.Nodes = append(data.Nodes, node)
+		data.ClusterRoutesString += fmt.Sprintf("%s\n", node.RouteUrl)
+	}
+	if nodeIndex < len(data.Nodes) {
+		data.Node = data.Nodes[nodeIndex]
+	}
+	return data
+}
+
+// previewComputeInstances stands in for instances that don't exist yet, so a
+// template can be checked before anything is provisioned
+func previewComputeInstances(clusterId string, n int) []cloud.ComputeInstance {
+	computeInstances := []cloud.ComputeInstance{}
+	for i := 0; i < n; i++ {
+		computeInstances = append(computeInstances, cloud.ComputeInstance{
+			DnsName:   fmt.Sprintf("node-%d.example.com", i),
+			PrivateIp: fmt.Sprintf("10.0.0.%d", i+1),
+			PublicIp:  fmt.Sprintf("192.0.2.%d", i+1),
+			AgentId:   fmt.Sprintf("%s-node-%d", clusterId, i),
+		})
+	}
+	return computeInstances
+}
+
+// renderServerConfig renders a server config and checks nats-server accepts it
+func renderServerConfig(tmpl *template.Template, data *serverConfigData) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	if err := tmpl.Execute(buffer, data); err != nil {
+		return nil, fmt.Errorf("unable to render server config, %v", err)
+	}
+	if _, err := parseServerConfig(buffer.Bytes()); err != nil {
+		return nil, fmt.Errorf("invalid server config for node %d, %v", data.NodeIndex, err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// parseServerConfig parses a server config the way nats-server does
+func parseServerConfig(config []byte) (*server.Options, error) {
+	dir, err := os.MkdirTemp("", "smithy-server-conf")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	configFilePath := filepath.Join(dir, "server.conf")
+	if err = os.WriteFile(configFilePath, config, 0644); err != nil {
+		return nil, err
+	}
+	opts, err := server.ProcessConfigFile(configFilePath)
+	if err != nil {
+		// the temporary file means nothing to the user
+		return nil, errors.New(strings.TrimSpace(strings.ReplaceAll(err.Error(), configFilePath+":", "line ")))
+	}
+	return opts, nil
+}
+
+// checkDefaultPorts fails unless a server config listens on the default client
+// and cluster ports, the only ones the aws security group opens
+func checkDefaultPorts(config []byte) error {
+	opts, err := parseServerConfig(config)
+	if err != nil {
+		return err
+	}
+	// unset ports are the defaults
+	clientPort, clusterPort := opts.Port, opts.Cluster.Port
+	if clientPort == 0 {
+		clientPort = cloud.DefaultClientPort
+	}
+	if clusterPort == 0 {
+		clusterPort = cloud.DefaultClusterPort
+	}
+	if clientPort != cloud.DefaultClientPort || clusterPort != cloud.DefaultClusterPort {
+		return fmt.Errorf("the server config listens on ports %d and %d, the security group only opens %d and %d", clientPort, clusterPort, cloud.DefaultClientPort, cloud.DefaultClusterPort)
+	}
+	return nil
+}
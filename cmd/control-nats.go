@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"smithy/internal/meta"
+	"smithy/pkg/agent"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// controlNatsCmd sends one of the nats-server lifecycle commands to the agents
+type controlNatsCmd struct {
+	metaCommand
+	command   string
+	action    string
+	serverUrl string
+	credsPath string
+	clusterId string
+	agentId   string
+	lameDuck  bool
+	timeout   time.Duration
+}
+
+func stopNatsCommand() subcommands.Command {
+	return &controlNatsCmd{
+		metaCommand: metaCommand{
+			name:     "stop-nats",
+			synopsis: "Stops the nats-server process of a cluster's agents",
+			usage:    "stop-nats -server <url> -creds <path/to/file> -id <string> [-agent <string>] [-lame-duck] [-t <duration>]",
+		},
+		command: agent.CommandStop,
+		action:  "stopped",
+	}
+}
+
+func restartNatsCommand() subcommands.Command {
+	return &controlNatsCmd{
+		metaCommand: metaCommand{
+			name:     "restart-nats",
+			synopsis: "Restarts the nats-server process of a cluster's agents with the config it was started with",
+			usage:    "restart-nats -server <url> -creds <path/to/file> -id <string> [-agent <string>] [-t <duration>]",
+		},
+		command: agent.CommandRestart,
+		action:  "restarted",
+	}
+}
+
+func reloadNatsCommand() subcommands.Command {
+	return &controlNatsCmd{
+		metaCommand: metaCommand{
+			name:     "reload-nats",
+			synopsis: "Fetches the cluster's current server config and has nats-server reload it",
+			usage:    "reload-nats -server <url> -creds <path/to/file> -id <string> [-agent <string>] [-t <duration>]",
+		},
+		command: agent.CommandReload,
+		action:  "reloaded",
+	}
+}
+
+func (c *controlNatsCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.serverUrl, "server", nats.DefaultURL, "Server URL")
+	f.StringVar(&c.credsPath, "creds", "", "Credentials file path")
+	f.StringVar(&c.clusterId, "id", "default", "Smithy cluster id")
+	f.StringVar(&c.clusterId, "cluster", "default", "Deprecated alias of -id")
+	f.StringVar(&c.agentId, "agent", "", "Only send the command to this agent (default: all agents of the cluster)")
+	if c.command == agent.CommandStop {
+		f.BoolVar(&c.lameDuck, "lame-duck", false, "Put nats-server in lame duck mode first, it takes the server's lame_duck_duration (2m by default) to exit")
+	}
+	f.DurationVar(&c.timeout, "t", 5*time.Minute, "How long to wait for the agents to reply")
+}
+
+func (c *controlNatsCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+
+	controlCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	nc, err := connect(c.serverUrl, c.credsPath)
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	defer nc.Close()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	smithyClustersDataBucket, err := js.KeyValue(controlCtx, meta.SmithyClustersDataBucketName)
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	// don't wait for replies of agents that can't exist
+	switch _, err = getClusterRecord(controlCtx, smithyClustersDataBucket, c.clusterId); err {
+	case nil:
+		// continue
+	case jetstream.ErrKeyNotFound:
+		fmt.Printf("smithy cluster id: %s does not exist\n", c.clusterId)
+		return subcommands.ExitFailure
+	default:
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	targets := []string{}
+	if c.agentId != "" {
+		targets = append(targets, c.agentId)
+	}
+	var commandArgs interface{}
+	if c.lameDuck {
+		commandArgs = &agent.StopArgs{LameDuck: true}
+	}
+
+	command, err := agent.NewCommand(c.command, targets, commandArgs)
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	replies, expected, err := sendAgentCommand(controlCtx, nc, c.clusterId, command)
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	return reportReplies(replies, expected, describePid(c.action))
+}
@@ -1,13 +1,16 @@
 package cmd
 
 import (
-	"bytes"
 	"context"
 	_ "embed"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"smithy/internal/meta"
+	"smithy/pkg/agent"
 	"smithy/pkg/aws"
 	"smithy/pkg/cloud"
 	"text/template"
@@ -18,18 +21,26 @@ import (
 	"github.com/nats-io/nats.go/jetstream"
 )
 
-type Deployer interface {
-	CreateComputeInstances(ctx context.Context, securityGroupName string, instanceGroupName string, instanceCount int32, credsPath string, clusterId string) ([]cloud.ComputeInstance, error)
-	CreateSecurityGroup(ctx context.Context, securityGroupName string) (securityGroupId string, err error)
-}
-
 type deployAgentsCmd struct {
 	metaCommand
 	numberOfAgents uint
 	serverUrl      string
 	credsPath      string
 	clusterId      string
+	provider       string
+	providerParams paramsFlag
 	timeout        time.Duration
+	ttl            time.Duration
+	monitorPort    int
+	configTemplate string
+	execAllow      string
+	// shorthands for aws provider params
+	awsRegion       string
+	awsImageId      string
+	awsImageSsm     string
+	awsInstanceType string
+	awsKeyName      string
+	smithyVersion   string
 }
 
 var (
@@ -37,12 +48,19 @@ var (
 	serverConfTemplate string
 )
 
+const (
+	// how long removing the resources of a failed deploy may take
+	rollbackTimeout = 10 * time.Minute
+	// the port nats-server serves monitoring on by default
+	defaultMonitorPort = 8222
+)
+
 func deployAgentsCommand() subcommands.Command {
 	return &deployAgentsCmd{
 		metaCommand: metaCommand{
 			name:     "deploy-agents",
 			synopsis: "provision a set agents, each within a compute instance",
-			usage:    "deploy-agent -id <string> -n <int> -t <duration> -server <url> -creds </path/to/file>",
+			usage:    "deploy-agent -id <string> -n <int> -t <duration> -server <url> -creds </path/to/file> -provider <string> [-ttl <duration>] [-monitor-port <int>] [-config-template <path>] [-exec-allow <program,program,...>] [-provider-param <key=value>]... [-region <string>] [-ami <string> | -ami-ssm-parameter <path>] [-instance-type <string>] [-key-name <string>] [-smithy-version <string>]",
 		},
 	}
 }
@@ -52,11 +70,69 @@ func (dac *deployAgentsCmd) SetFlags(f *flag.FlagSet) {
 	f.UintVar(&dac.numberOfAgents, "n", 3, "number of agents")
 	f.StringVar(&dac.serverUrl, "server", nats.DefaultURL, "url to command server")
 	f.StringVar(&dac.credsPath, "creds", "", "path to creds file")
+	f.StringVar(&dac.provider, "provider", cloud.DefaultProvider, fmt.Sprintf("cloud provider %v", cloud.Providers()))
+	dac.providerParams = paramsFlag{}
+	f.Var(dac.providerParams, "provider-param", "provider specific setting as key=value, may be repeated")
+	f.StringVar(&dac.awsRegion, "region", "", fmt.Sprintf("aws region (default %s)", aws.DefaultRegion))
+	f.StringVar(&dac.awsImageId, "ami", "", "aws image id")
+	f.StringVar(&dac.awsImageSsm, "ami-ssm-parameter", "", "aws ssm parameter holding the image id, e.g. "+aws.DefaultImageSsmParameter)
+	f.StringVar(&dac.awsInstanceType, "instance-type", "", fmt.Sprintf("aws instance type (default %s)", aws.DefaultInstanceType))
+	f.StringVar(&dac.awsKeyName, "key-name", "", fmt.Sprintf("aws key pair name (default %s)", aws.DefaultKeyName))
+	f.StringVar(&dac.smithyVersion, "smithy-version", "", "smithy release the aws nodes install (default: the release of this smithy)")
 	f.DurationVar(&dac.timeout, "t", 10*time.Minute, "timeout duration for all context operations")
+	f.IntVar(&dac.monitorPort, "monitor-port", defaultMonitorPort, "nats-server http monitoring port, the agents poll it to tell whether the server is healthy")
+	f.DurationVar(&dac.ttl, "ttl", 0, "time after which the reaper tears the cluster down, 0 keeps it until teardown-agents")
+	f.StringVar(&dac.execAllow, "exec-allow", "", "comma separated programs the agents' exec command may run with any arguments, e.g. "+agent.SuggestedExecAllow+" (default: exec is disabled)")
+	f.StringVar(&dac.configTemplate, "config-template", "", "server config template rendered for every node, see serverConfigData for what it can use, aws nodes only accept connections on the default client and cluster ports (default: the embedded server.conf.tmpl)")
 }
 
 func (dac *deployAgentsCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
 
+	// fold the aws shorthands into the provider params
+	awsParams := map[string]string{
+		aws.ParamRegion:            dac.awsRegion,
+		aws.ParamImageId:           dac.awsImageId,
+		aws.ParamImageSsmParameter: dac.awsImageSsm,
+		aws.ParamInstanceType:      dac.awsInstanceType,
+		aws.ParamKeyName:           dac.awsKeyName,
+		aws.ParamSmithyVersion:     dac.smithyVersion,
+	}
+	if dac.ttl < 0 {
+		log.Println("ttl must not be negative")
+		return subcommands.ExitUsageError
+	}
+
+	// catch template mistakes before anything is provisioned
+	tmpl, err := dac.serverConfigTemplate()
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitUsageError
+	}
+	previewInstances := previewComputeInstances(dac.clusterId, int(dac.numberOfAgents))
+	for nodeIndex := range previewInstances {
+		config, err := renderServerConfig(tmpl, newServerConfigData(dac.clusterId, previewInstances, nodeIndex, dac.monitorPort))
+		if err == nil && dac.provider == aws.ProviderName {
+			err = checkDefaultPorts(config)
+		}
+		if err != nil {
+			log.Println(err.Error())
+			return subcommands.ExitUsageError
+		}
+	}
+
+	for key, value := range awsParams {
+		if value == "" {
+			continue
+		}
+		if dac.provider != aws.ProviderName {
+			log.Printf("-%s is only supported by the %s provider", key, aws.ProviderName)
+			return subcommands.ExitUsageError
+		}
+		dac.providerParams[key] = value
+	}
+
+	execAllow := agent.ParseExecAllow(dac.execAllow)
+
 	// timeout context
 	deployCtx, cancel := context.WithTimeout(ctx, dac.timeout)
 	defer cancel()
@@ -90,110 +166,256 @@ func (dac *deployAgentsCmd) Execute(ctx context.Context, f *flag.FlagSet, args .
 	}
 	// bind to smithy cluster bucket
 	smithyClustersDataBucket, err := js.KeyValue(deployCtx, meta.SmithyClustersDataBucketName)
+	if err == jetstream.ErrBucketNotFound {
+		log.Printf("bucket %s does not exist, run `%s init` first", meta.SmithyClustersDataBucketName, Name)
+		return subcommands.ExitFailure
+	}
 	if err != nil {
 		log.Println(err.Error())
 		return subcommands.ExitFailure
 	}
 
-	// check if clusterId already exists
-	_, err = smithyClustersDataBucket.Get(deployCtx, dac.clusterId)
-	switch err {
-	case nil:
-		log.Printf("smithy cluster %s already exists, nothing to create", dac.clusterId)
-		return subcommands.ExitUsageError
-	case jetstream.ErrKeyNotFound:
-		// continue
-	default:
+	// only one operation may run on a cluster at a time
+	lease, err := acquireLease(deployCtx, smithyClustersDataBucket, dac.clusterId, cloud.OperationDeploy, dac.timeout+rollbackTimeout+recordTimeout)
+	if err != nil {
 		log.Println(err.Error())
 		return subcommands.ExitFailure
 	}
+	defer lease.release(ctx)
 
 	// create deployer service
-	// TODO: make into a (cloud-provider) factory
-	var deployer Deployer
-	deployer, err = aws.New(deployCtx)
+	var deployer cloud.Provider
+	deployer, err = cloud.New(deployCtx, dac.provider, cloud.Options{
+		ServerUrl: dac.serverUrl,
+		Params:    dac.providerParams,
+		ExecAllow: execAllow,
+	})
 	if err != nil {
 		log.Println(err.Error())
 		return subcommands.ExitFailure
 	}
 
-	log.Printf("creating security group: %s", securityGroupName)
-	securityGroupId, err := deployer.CreateSecurityGroup(deployCtx, securityGroupName)
+	if validator, ok := deployer.(cloud.Validator); ok {
+		if err = validator.ValidateDeploy(); err != nil {
+			log.Println(err.Error())
+			return subcommands.ExitUsageError
+		}
+	}
+
+	// persist the settings the provider actually uses, defaults included
+	if parameterized, ok := deployer.(cloud.Parameterized); ok {
+		for key, value := range parameterized.Params() {
+			dac.providerParams[key] = value
+		}
+	}
+
+	agentCluster := &cloud.AgentCluster{
+		Provider:          dac.provider,
+		ProviderParams:    dac.providerParams,
+		SecurityGroupName: securityGroupName,
+		ExecAllow:         execAllow,
+	}
+	agentCluster.SetStatus(cloud.StatusProvisioning, nil)
+
+	// claim the cluster id, the entry shows everybody the cluster is in flight
+	record, err := createClusterRecord(deployCtx, smithyClustersDataBucket, dac.clusterId, agentCluster)
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		if existing, err := getClusterRecord(deployCtx, smithyClustersDataBucket, dac.clusterId); err == nil {
+			log.Printf("smithy cluster %s already exists (%s), nothing to create", dac.clusterId, describeStatus(existing.AgentCluster))
+		} else {
+			log.Printf("smithy cluster %s already exists, nothing to create", dac.clusterId)
+		}
+		return subcommands.ExitUsageError
+	}
 	if err != nil {
 		log.Println(err.Error())
 		return subcommands.ExitFailure
 	}
+	fmt.Printf("created smithy cluster entry %s\n", dac.clusterId)
+
+	log.Printf("creating security group: %s", securityGroupName)
+	securityGroupId, err := deployer.CreateSecurityGroup(deployCtx, securityGroupName, dac.clusterId)
+	if err != nil {
+		// the group may exist even though it couldn't be set up
+		record.SecurityGroupId = securityGroupId
+		dac.abort(ctx, deployer, record, err)
+		return subcommands.ExitFailure
+	}
 	log.Printf("created security group %s: %s", securityGroupName, securityGroupId)
 
+	record.SecurityGroupId = securityGroupId
+	if err = record.setStatus(deployCtx, cloud.StatusStarting, nil); err != nil {
+		dac.abort(ctx, deployer, record, err)
+		return subcommands.ExitFailure
+	}
+
 	log.Printf("creating %d compute instances", dac.numberOfAgents)
 	computeInstances, err := deployer.CreateComputeInstances(deployCtx, securityGroupName, instanceTagName, int32(dac.numberOfAgents), dac.credsPath, dac.clusterId)
 	if err != nil {
-		log.Println(err.Error())
+		// providers clean up the instances of a failed launch themselves
+		dac.abort(ctx, deployer, record, err)
 		return subcommands.ExitFailure
 	}
+	// configs tell nodes apart by their position, which has to match the node's id
+	for nodeIndex, ci := range computeInstances {
+		if agentId := fmt.Sprintf("%s-node-%d", dac.clusterId, nodeIndex); ci.AgentId != agentId {
+			err = fmt.Errorf("compute instance %s is %s, expected %s at its position", ci.InstanceId, ci.AgentId, agentId)
+			record.ComputeInstances = computeInstances
+			dac.abort(ctx, deployer, record, err)
+			return subcommands.ExitFailure
+		}
+	}
 	for _, ci := range computeInstances {
 		log.Printf("created compute instance %s - DnsName: %s, InstanceId: %s, PrivateIp: %s, PublicIp: %s", instanceTagName, ci.DnsName, ci.InstanceId, ci.PrivateIp, ci.PublicIp)
 	}
 
+	record.ComputeInstances = computeInstances
+	if dac.ttl > 0 {
+		expiresAt := time.Now().Add(dac.ttl).UTC()
+		record.ExpiresAt = &expiresAt
+	}
+	if err = record.setStatus(deployCtx, cloud.StatusConfiguring, nil); err != nil {
+		// without the instances in the entry teardown-agents can't find them all
+		dac.abort(ctx, deployer, record, err)
+		return subcommands.ExitFailure
+	}
+
 	//  print NATS urls
 	fmt.Println("nats urls:")
 	for _, ci := range computeInstances {
-		fmt.Printf("nats://%s:4222,", ci.DnsName)
+		fmt.Printf("%s,", ci.ClientUrl())
 	}
 	// get rid of trailing comma and add newline
 	fmt.Printf("\b\n")
 
-	// get cluster urls
-	clusterUrlsString := ""
-	for _, ci := range computeInstances {
-		clusterUrlsString += fmt.Sprintf("nats://%s:6222\n", ci.DnsName)
+	// the agents create the heartbeat bucket themselves if it is missing
+	if _, err = agent.HeartbeatBucket(deployCtx, js, dac.clusterId); err != nil {
+		log.Println(err.Error())
 	}
 
-	agentCluster := &cloud.AgentCluster{
-		SecurityGroupName: securityGroupName,
-		SecurityGroupId:   securityGroupId,
-		ComputeInstances:  computeInstances,
+	jsObj, err := nc.JetStream()
+	if err != nil {
+		log.Println(err.Error())
+		record.fail(ctx, err)
+		return subcommands.ExitFailure
 	}
-
-	// create entry in smithy cluster bucket
-	if _, err = smithyClustersDataBucket.Create(deployCtx, dac.clusterId, agentCluster.Bytes()); err != nil {
+	obj, err := jsObj.ObjectStore(meta.SmithyClustersObjStoreName)
+	if err != nil {
 		log.Println(err.Error())
+		record.fail(ctx, err)
 		return subcommands.ExitFailure
 	}
-	fmt.Printf("created smithy cluster entry %s\n", dac.clusterId)
 
-	// fill out server.conf template
-	configData := map[string]string{
-		"ClusterName":         dac.clusterId,
-		"ClusterRoutesString": clusterUrlsString,
+	if err = dac.uploadServerConfigs(obj, tmpl, computeInstances); err != nil {
+		log.Println(err.Error())
+		record.fail(ctx, err)
+		return subcommands.ExitFailure
 	}
 
-	tmpl := template.Must(template.New("server.conf").Parse(serverConfTemplate))
-
-	buffer := new(bytes.Buffer)
-	err = tmpl.Execute(buffer, configData)
-	if err != nil {
+	if err = record.setStatus(deployCtx, cloud.StatusRunning, nil); err != nil {
 		log.Println(err.Error())
 		return subcommands.ExitFailure
 	}
+	if record.ExpiresAt != nil {
+		fmt.Printf("smithy cluster %s expires at %s\n", dac.clusterId, record.ExpiresAt.Local().Format(time.RFC3339))
+	}
 
-	jsObj, err := nc.JetStream()
+	return subcommands.ExitSuccess
+}
+
+// serverConfigTemplate parses the template given with -config-template, or the embedded one
+func (dac *deployAgentsCmd) serverConfigTemplate() (*template.Template, error) {
+	if dac.configTemplate == "" {
+		return template.New("server.conf").Parse(serverConfTemplate)
+	}
+	content, err := os.ReadFile(dac.configTemplate)
 	if err != nil {
-		log.Println(err.Error())
-		return subcommands.ExitFailure
+		return nil, fmt.Errorf("unable to read config template, %v", err)
 	}
-	obj, err := jsObj.ObjectStore(meta.SmithyClustersObjStoreName)
+	tmpl, err := template.New(filepath.Base(dac.configTemplate)).Parse(string(content))
 	if err != nil {
-		log.Println(err.Error())
-		return subcommands.ExitFailure
+		return nil, fmt.Errorf("unable to parse config template, %v", err)
 	}
+	return tmpl, nil
+}
 
-	configFileName := fmt.Sprintf("%s-server.conf", dac.clusterId)
-	_, err = obj.PutBytes(configFileName, buffer.Bytes())
+// uploadServerConfigs renders the server configs and stores them for the agents.
+// The shared config, rendered for the first node, is what agents of older
+// releases and agents without a config of their own fetch. Custom templates
+// also render a config per node, which agents prefer.
+func (dac *deployAgentsCmd) uploadServerConfigs(obj nats.ObjectStore, tmpl *template.Template, computeInstances []cloud.ComputeInstance) error {
+	config, err := renderServerConfig(tmpl, newServerConfigData(dac.clusterId, computeInstances, 0, dac.monitorPort))
 	if err != nil {
+		return err
+	}
+	if _, err = obj.PutBytes(agent.ConfigObjectName(dac.clusterId), config); err != nil {
+		return err
+	}
+	// the embedded template renders the same config for every node
+	if dac.configTemplate == "" {
+		return nil
+	}
+
+	for nodeIndex, ci := range computeInstances {
+		if ci.AgentId == "" {
+			return fmt.Errorf("provider %s doesn't tell the agent ids, per node configs can't be used", dac.provider)
+		}
+		config, err := renderServerConfig(tmpl, newServerConfigData(dac.clusterId, computeInstances, nodeIndex, dac.monitorPort))
+		if err != nil {
+			return err
+		}
+		if _, err = obj.PutBytes(agent.NodeConfigObjectName(dac.clusterId, ci.AgentId), config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abort rolls a failed deploy back, the cluster entry is removed along with the
+// resources or, if they can't be, kept as failed so the cluster can be torn down
+func (dac *deployAgentsCmd) abort(ctx context.Context, terminator cloud.Terminator, record *clusterRecord, failure error) {
+	log.Println(failure.Error())
+
+	if err := rollback(ctx, terminator, record.SecurityGroupName, record.SecurityGroupId, record.ComputeInstances); err != nil {
+		if err = record.fail(ctx, fmt.Errorf("%v (rollback failed: %v)", failure, err)); err != nil {
+			log.Println(err.Error())
+		}
+		return
+	}
+
+	deleteCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), recordTimeout)
+	defer cancel()
+	if err := record.delete(deleteCtx); err != nil {
 		log.Println(err.Error())
-		return subcommands.ExitFailure
 	}
+}
 
-	return subcommands.ExitSuccess
+// rollback removes the resources of a failed deploy, it doesn't use the deploy
+// context since that may be what expired
+func rollback(ctx context.Context, terminator cloud.Terminator, securityGroupName string, securityGroupId string, computeInstances []cloud.ComputeInstance) error {
+	rollbackCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+	defer cancel()
+
+	if len(computeInstances) > 0 {
+		instanceIds := []string{}
+		for _, ci := range computeInstances {
+			instanceIds = append(instanceIds, ci.InstanceId)
+		}
+		log.Printf("rolling back, terminating compute instances: %v", instanceIds)
+		if err := terminator.TerminateComputeInstances(rollbackCtx, instanceIds); err != nil {
+			log.Printf("unable to terminate compute instances %v, they need to be terminated by hand: %v", instanceIds, err)
+			return err
+		}
+	}
+
+	if securityGroupId == "" {
+		return nil
+	}
+
+	log.Printf("rolling back, deleting security group %s: %s", securityGroupName, securityGroupId)
+	if err := terminator.DeleteSecurityGroup(rollbackCtx, securityGroupId); err != nil {
+		log.Printf("unable to delete security group %s, it needs to be deleted by hand: %v", securityGroupId, err)
+		return err
+	}
+	return nil
 }
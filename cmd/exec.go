@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"smithy/pkg/agent"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/nats-io/nats.go"
+)
+
+type execCmd struct {
+	metaCommand
+	serverUrl string
+	credsPath string
+	clusterId string
+	agentId   string
+	timeout   time.Duration
+}
+
+func execCommand() subcommands.Command {
+	return &execCmd{
+		metaCommand: metaCommand{
+			name:     "exec",
+			synopsis: "run a diagnostic command on the agents of a cluster, its program has to be allowed by the cluster's -exec-allow",
+			usage:    "exec -id <string> -server <url> -creds </path/to/file> [-agent <string>] [-t <duration>] -- <command> [args...]",
+		},
+	}
+}
+
+func (ec *execCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&ec.clusterId, "id", "default", "smithy cluster id")
+	f.StringVar(&ec.serverUrl, "server", nats.DefaultURL, "url of the command server")
+	f.StringVar(&ec.credsPath, "creds", "", "path to creds file")
+	f.StringVar(&ec.agentId, "agent", "", "only run the command on this agent (default: all agents of the cluster)")
+	f.DurationVar(&ec.timeout, "t", 30*time.Second, "how long the command may run")
+}
+
+// time on top of the command's timeout for the replies to arrive
+const execReplyGracePeriod = 5 * time.Second
+
+func (ec *execCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+
+	argv := f.Args()
+	if len(argv) == 0 {
+		fmt.Println("no command to run, usage:", ec.usage)
+		return subcommands.ExitUsageError
+	}
+
+	execCtx, cancel := context.WithTimeout(ctx, ec.timeout+execReplyGracePeriod)
+	defer cancel()
+
+	nc, err := connect(ec.serverUrl, ec.credsPath)
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	defer nc.Close()
+
+	targets := []string{}
+	if ec.agentId != "" {
+		targets = append(targets, ec.agentId)
+	}
+	command, err := agent.NewCommand(agent.CommandExec, targets, &agent.ExecArgs{
+		Argv:    argv,
+		Timeout: ec.timeout,
+	})
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	replies, expected, err := sendAgentCommand(execCtx, nc, ec.clusterId, command)
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	return printExecResults(replies, expected)
+}
+
+// printExecResults prints the output of every agent in a group of its own, it
+// fails unless the command ran and exited with 0 on every agent
+func printExecResults(replies []*agent.Reply, expected []string) subcommands.ExitStatus {
+	status := subcommands.ExitSuccess
+
+	sort.Slice(replies, func(i, j int) bool {
+		return replies[i].AgentId < replies[j].AgentId
+	})
+	replied := map[string]bool{}
+
+	for _, reply := range replies {
+		replied[reply.AgentId] = true
+		data := &agent.ExecData{}
+		if !reply.Ok {
+			fmt.Printf("=== %s: error: %s\n", reply.AgentId, reply.Error)
+			status = subcommands.ExitFailure
+			continue
+		}
+		if err := json.Unmarshal(reply.Data, data); err != nil {
+			fmt.Printf("=== %s: unreadable reply: %v\n", reply.AgentId, err)
+			status = subcommands.ExitFailure
+			continue
+		}
+		fmt.Printf("=== %s: exit code %d\n", reply.AgentId, data.ExitCode)
+		if data.ExitCode != 0 {
+			status = subcommands.ExitFailure
+		}
+		printOutput("stdout", data.Stdout)
+		printOutput("stderr", data.Stderr)
+		if data.Truncated {
+			fmt.Println("--- output truncated")
+		}
+	}
+	for _, agentId := range expected {
+		if !replied[agentId] {
+			fmt.Printf("=== %s: no reply\n", agentId)
+			status = subcommands.ExitFailure
+		}
+	}
+
+	if len(replies) == 0 && len(expected) == 0 {
+		fmt.Println("no agent replied")
+		status = subcommands.ExitFailure
+	}
+	return status
+}
+
+// printOutput prints a non empty output under a header
+func printOutput(name string, output string) {
+	if output == "" {
+		return
+	}
+	fmt.Printf("--- %s\n%s", name, output)
+	if !strings.HasSuffix(output, "\n") {
+		fmt.Println()
+	}
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"smithy/internal/meta"
+	"smithy/pkg/cloud"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+type extendCmd struct {
+	metaCommand
+	clusterId string
+	serverUrl string
+	credsPath string
+	by        time.Duration
+	timeout   time.Duration
+}
+
+func extendCommand() subcommands.Command {
+	return &extendCmd{
+		metaCommand: metaCommand{
+			name:     "extend",
+			synopsis: "push out the time a smithy cluster is torn down by the reaper",
+			usage:    "extend -id <string> -by <duration> -server <url> -creds </path/to/file>",
+		},
+	}
+}
+
+func (ec *extendCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&ec.clusterId, "id", "default", "smithy cluster id")
+	f.StringVar(&ec.serverUrl, "server", nats.DefaultURL, "url of the command server")
+	f.StringVar(&ec.credsPath, "creds", "", "path to creds file")
+	f.DurationVar(&ec.by, "by", 0, "how much longer the cluster lives, counted from its current expiry or from now if it already expired")
+	f.DurationVar(&ec.timeout, "t", time.Minute, "timeout duration")
+}
+
+func (ec *extendCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+
+	if ec.by <= 0 {
+		log.Println("-by must be positive")
+		return subcommands.ExitUsageError
+	}
+
+	extendCtx, cancel := context.WithTimeout(ctx, ec.timeout)
+	defer cancel()
+
+	nc, err := connect(ec.serverUrl, ec.credsPath)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	defer nc.Close()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	smithyClustersDataBucket, err := js.KeyValue(extendCtx, meta.SmithyClustersDataBucketName)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+
+	lease, err := acquireLease(extendCtx, smithyClustersDataBucket, ec.clusterId, cloud.OperationExtend, ec.timeout)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	defer lease.release(ctx)
+
+	record, err := getClusterRecord(extendCtx, smithyClustersDataBucket, ec.clusterId)
+	switch err {
+	case nil:
+		// continue
+	case jetstream.ErrKeyNotFound:
+		log.Printf("smithy cluster id: %s does not exist", ec.clusterId)
+		return subcommands.ExitFailure
+	default:
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+
+	if record.ExpiresAt == nil {
+		log.Printf("smithy cluster %s has no ttl, it is kept until it is torn down", ec.clusterId)
+		return subcommands.ExitUsageError
+	}
+
+	expiresAt := *record.ExpiresAt
+	if now := time.Now(); expiresAt.Before(now) {
+		expiresAt = now
+	}
+	expiresAt = expiresAt.Add(ec.by).UTC()
+	record.ExpiresAt = &expiresAt
+
+	// fails if the cluster changed, or was reaped, since it was read
+	if err = record.save(extendCtx); err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	fmt.Printf("smithy cluster %s expires at %s\n", ec.clusterId, expiresAt.Local().Format(time.RFC3339))
+
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// paramsFlag collects repeated key=value flags into a map
+type paramsFlag map[string]string
+
+func (pf paramsFlag) String() string {
+	pairs := []string{}
+	for key, value := range pf {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (pf paramsFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	pf[key] = val
+	return nil
+}
+
+// agentIdsFlag is a comma separated list of agent ids
+type agentIdsFlag []string
+
+func (af *agentIdsFlag) String() string {
+	return strings.Join(*af, ",")
+}
+
+func (af *agentIdsFlag) Set(value string) error {
+	for _, agentId := range strings.Split(value, ",") {
+		if agentId = strings.TrimSpace(agentId); agentId != "" {
+			*af = append(*af, agentId)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,358 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"smithy/internal/meta"
+	"smithy/pkg/agent"
+	"smithy/pkg/cloud"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// suffix of the server config object of every cluster, per node configs are
+// named <cluster>-server.conf/<agent>
+const serverConfSuffix = "-server.conf"
+
+// configClusterId returns the cluster a server config object belongs to
+func configClusterId(objectName string) (string, bool) {
+	// collected diagnostics include server configs, they are no configs themselves
+	if isCollectObject(objectName) {
+		return "", false
+	}
+	clusterId, rest, found := strings.Cut(objectName, serverConfSuffix)
+	if !found || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return "", false
+	}
+	return clusterId, true
+}
+
+// isCollectObject tells whether an object was uploaded for the collect command
+func isCollectObject(objectName string) bool {
+	return strings.HasPrefix(objectName, agent.CollectObjectPrefix+"/")
+}
+
+type gcCmd struct {
+	metaCommand
+	serverUrl      string
+	credsPath      string
+	provider       string
+	providerParams paramsFlag
+	minAge         time.Duration
+	yes            bool
+	timeout        time.Duration
+}
+
+func gcCommand() subcommands.Command {
+	return &gcCmd{
+		metaCommand: metaCommand{
+			name:     "gc",
+			synopsis: "remove cloud resources, cluster entries, configs and collect uploads that nothing owns anymore",
+			usage:    "gc -server <url> -creds </path/to/file> -provider <string> [-provider-param <key=value>]... [-min-age <duration>] [-yes]",
+		},
+	}
+}
+
+func (gc *gcCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&gc.serverUrl, "server", nats.DefaultURL, "url of the command server")
+	f.StringVar(&gc.credsPath, "creds", "", "path to creds file")
+	f.StringVar(&gc.provider, "provider", cloud.DefaultProvider, fmt.Sprintf("cloud provider to look for resources in %v", cloud.Providers()))
+	gc.providerParams = paramsFlag{}
+	f.Var(gc.providerParams, "provider-param", "provider specific setting as key=value, e.g. region=us-west-2, may be repeated")
+	f.DurationVar(&gc.minAge, "min-age", time.Hour, "only collect what is at least this old, so deploys in progress are left alone")
+	f.BoolVar(&gc.yes, "yes", false, "don't ask for confirmation")
+	f.DurationVar(&gc.timeout, "t", 30*time.Minute, "timeout duration")
+}
+
+// staleCluster is a cluster entry at the revision it was found stale at
+type staleCluster struct {
+	clusterId string
+	revision  uint64
+}
+
+// gcPlan is what a gc run removes
+type gcPlan struct {
+	instances      []cloud.Resource
+	securityGroups []cloud.Resource
+	// entries of clusters whose resources are all gone
+	staleClusters []staleCluster
+	// server configs without a cluster entry
+	configNames []string
+	// diagnostics uploaded for collect commands that never picked them up
+	collectNames []string
+}
+
+func (p *gcPlan) empty() bool {
+	return len(p.instances) == 0 && len(p.securityGroups) == 0 && len(p.staleClusters) == 0 && len(p.configNames) == 0 && len(p.collectNames) == 0
+}
+
+func (p *gcPlan) print() {
+	for _, resource := range append(append([]cloud.Resource{}, p.instances...), p.securityGroups...) {
+		age := "unknown age"
+		if !resource.CreatedAt.IsZero() {
+			age = "created " + resource.CreatedAt.Local().Format(time.RFC3339)
+		}
+		fmt.Printf("orphaned %s %s (%s, cluster %s, %s)\n", resource.Kind, resource.Id, resource.Name, resource.ClusterId, age)
+	}
+	for _, stale := range p.staleClusters {
+		fmt.Printf("stale cluster entry %s\n", stale.clusterId)
+	}
+	for _, configName := range p.configNames {
+		fmt.Printf("orphaned config %s\n", configName)
+	}
+	for _, collectName := range p.collectNames {
+		fmt.Printf("stale collect upload %s\n", collectName)
+	}
+}
+
+func (gc *gcCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+
+	gcCtx, cancel := context.WithTimeout(ctx, gc.timeout)
+	defer cancel()
+
+	nc, err := connect(gc.serverUrl, gc.credsPath)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	defer nc.Close()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	smithyClustersDataBucket, err := js.KeyValue(gcCtx, meta.SmithyClustersDataBucketName)
+	if err == jetstream.ErrBucketNotFound {
+		log.Printf("bucket %s does not exist, run `%s init` first", meta.SmithyClustersDataBucketName, Name)
+		return subcommands.ExitFailure
+	}
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	jsObj, err := nc.JetStream()
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	obj, err := jsObj.ObjectStore(meta.SmithyClustersObjStoreName)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+
+	provider, err := cloud.New(gcCtx, gc.provider, cloud.Options{
+		ServerUrl: gc.serverUrl,
+		Params:    gc.providerParams,
+	})
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	lister, ok := provider.(cloud.Lister)
+	if !ok {
+		log.Printf("provider %s can't list its resources", gc.provider)
+		return subcommands.ExitUsageError
+	}
+
+	plan, err := gc.plan(gcCtx, lister, smithyClustersDataBucket, obj)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	if plan.empty() {
+		fmt.Println("nothing to collect")
+		return subcommands.ExitSuccess
+	}
+	plan.print()
+
+	if !gc.yes {
+		fmt.Print("remove all of the above? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			fmt.Println("nothing removed")
+			return subcommands.ExitSuccess
+		}
+	}
+
+	// keep going on errors, whatever can be removed should be
+	status := subcommands.ExitSuccess
+
+	if len(plan.instances) > 0 {
+		instanceIds := []string{}
+		for _, resource := range plan.instances {
+			instanceIds = append(instanceIds, resource.Id)
+		}
+		log.Printf("terminating compute instances: %v", instanceIds)
+		if err = provider.TerminateComputeInstances(gcCtx, instanceIds); err != nil {
+			log.Println(err.Error())
+			status = subcommands.ExitFailure
+		}
+	}
+
+	for _, resource := range plan.securityGroups {
+		log.Printf("deleting security group %s: %s", resource.Name, resource.Id)
+		if err = provider.DeleteSecurityGroup(gcCtx, resource.Id); err != nil {
+			log.Println(err.Error())
+			status = subcommands.ExitFailure
+		}
+	}
+
+	for _, stale := range plan.staleClusters {
+		log.Printf("deleting cluster entry %s", stale.clusterId)
+		if err = gc.deleteStaleCluster(gcCtx, smithyClustersDataBucket, stale); err != nil {
+			log.Println(err.Error())
+			status = subcommands.ExitFailure
+		}
+	}
+
+	for _, configName := range plan.configNames {
+		log.Printf("deleting config %s", configName)
+		if err = obj.Delete(configName); err != nil {
+			log.Println(err.Error())
+			status = subcommands.ExitFailure
+		}
+	}
+
+	for _, collectName := range plan.collectNames {
+		log.Printf("deleting collect upload %s", collectName)
+		if err = obj.Delete(collectName); err != nil {
+			log.Println(err.Error())
+			status = subcommands.ExitFailure
+		}
+	}
+
+	return status
+}
+
+// deleteStaleCluster deletes a cluster entry unless it changed since it was found stale
+func (gc *gcCmd) deleteStaleCluster(ctx context.Context, smithyClustersDataBucket jetstream.KeyValue, stale staleCluster) error {
+	lease, err := acquireLease(ctx, smithyClustersDataBucket, stale.clusterId, cloud.OperationGc, gc.timeout)
+	if err != nil {
+		return err
+	}
+	defer lease.release(ctx)
+
+	if err = smithyClustersDataBucket.Delete(ctx, stale.clusterId, jetstream.LastRevision(stale.revision)); err != nil {
+		return fmt.Errorf("unable to delete smithy cluster %s, %v", stale.clusterId, err)
+	}
+	return nil
+}
+
+// plan cross-references the provider's resources with the cluster entries and configs
+func (gc *gcCmd) plan(ctx context.Context, lister cloud.Lister, smithyClustersDataBucket jetstream.KeyValue, obj nats.ObjectStore) (*gcPlan, error) {
+	plan := &gcPlan{}
+	cutoff := time.Now().Add(-gc.minAge)
+
+	clusterIds, err := smithyClustersDataBucket.Keys(ctx)
+	if err != nil && err != jetstream.ErrNoKeysFound {
+		return nil, fmt.Errorf("unable to list cluster entries, %v", err)
+	}
+	// leave clusters alone while somebody works on them
+	leases := activeLeases(ctx, smithyClustersDataBucket, clusterIds)
+
+	resources, err := lister.ListResources(ctx)
+	if err != nil {
+		return nil, err
+	}
+	existing := map[string]bool{}
+	for _, resource := range resources {
+		existing[resource.Id] = true
+	}
+
+	// resources referenced by the clusters deployed with this provider, in its scope
+	referenced := map[string]bool{}
+	known := map[string]bool{}
+	for _, clusterId := range clusterIds {
+		if !isClusterKey(clusterId) {
+			continue
+		}
+		known[clusterId] = true
+
+		entry, err := smithyClustersDataBucket.Get(ctx, clusterId)
+		if err == jetstream.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to get cluster entry %s, %v", clusterId, err)
+		}
+		agentCluster, err := cloud.LoadAgentCluster(entry.Value())
+		if err != nil {
+			// never collect what can't be read, it might still be in use
+			log.Printf("skipping cluster %s: %v", clusterId, err)
+			continue
+		}
+		if agentCluster.Provider != gc.provider || !lister.InScope(agentCluster.ProviderParams) {
+			continue
+		}
+
+		ids := []string{agentCluster.SecurityGroupId}
+		for _, ci := range agentCluster.ComputeInstances {
+			ids = append(ids, ci.InstanceId)
+		}
+		stale := true
+		for _, id := range ids {
+			referenced[id] = true
+			if existing[id] {
+				stale = false
+			}
+		}
+		if _, leased := leases[clusterId]; stale && !leased && entry.Created().Before(cutoff) {
+			plan.staleClusters = append(plan.staleClusters, staleCluster{clusterId: clusterId, revision: entry.Revision()})
+		}
+	}
+
+	for _, resource := range resources {
+		if _, leased := leases[resource.ClusterId]; leased || referenced[resource.Id] || resource.CreatedAt.After(cutoff) {
+			continue
+		}
+		switch resource.Kind {
+		case cloud.ResourceInstance:
+			plan.instances = append(plan.instances, resource)
+		case cloud.ResourceSecurityGroup:
+			plan.securityGroups = append(plan.securityGroups, resource)
+		}
+	}
+
+	// stale clusters take their config with them
+	for _, stale := range plan.staleClusters {
+		delete(known, stale.clusterId)
+	}
+	objects, err := obj.List()
+	if err != nil && err != nats.ErrNoObjectsFound {
+		return nil, fmt.Errorf("unable to list configs, %v", err)
+	}
+	for _, object := range objects {
+		if object.ModTime.After(cutoff) {
+			continue
+		}
+		// collect deletes what it downloaded, leftovers are from collects that died
+		if isCollectObject(object.Name) {
+			plan.collectNames = append(plan.collectNames, object.Name)
+			continue
+		}
+		clusterId, ok := configClusterId(object.Name)
+		if !ok {
+			continue
+		}
+		if _, leased := leases[clusterId]; !leased && !known[clusterId] {
+			plan.configNames = append(plan.configNames, object.Name)
+		}
+	}
+
+	sort.Slice(plan.staleClusters, func(i, j int) bool {
+		return plan.staleClusters[i].clusterId < plan.staleClusters[j].clusterId
+	})
+	sort.Strings(plan.configNames)
+	sort.Strings(plan.collectNames)
+	return plan, nil
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"smithy/internal/meta"
+	"smithy/pkg/cloud"
 
 	"github.com/google/subcommands"
 	"github.com/nats-io/nats.go"
@@ -41,19 +42,7 @@ func (ec *getInfoCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...inte
 		return subcommands.ExitFailure
 	}
 
-	// --------------------
-	// HACK: pull out later
-
-	// default options
-	opts := []nats.Option{}
-
-	// if supplied a creds file, use it
-	if ec.credsPath != "" {
-		opts = append(opts, nats.UserCredentials(ec.credsPath))
-	}
-
-	// create NATS connection
-	nc, err := nats.Connect(ec.serverUrl, opts...)
+	nc, err := connect(ec.serverUrl, ec.credsPath)
 	if err != nil {
 		log.Println(err.Error())
 		return subcommands.ExitFailure
@@ -71,7 +60,6 @@ func (ec *getInfoCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...inte
 		log.Println(err.Error())
 		return subcommands.ExitFailure
 	}
-	// --------------------
 
 	smithyClusterEntry, err := smithyClustersDataBucket.Get(ctx, ec.smithyClusterId)
 	switch err {
@@ -85,8 +73,13 @@ func (ec *getInfoCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...inte
 		return subcommands.ExitFailure
 	}
 
-	// print cluster info
-	fmt.Println(string(smithyClusterEntry.Value()))
+	// print cluster info, with the defaults of older entries filled in
+	agentCluster, err := cloud.LoadAgentCluster(smithyClusterEntry.Value())
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	fmt.Println(string(agentCluster.Bytes()))
 
 	return subcommands.ExitSuccess
 }
@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"smithy/internal/meta"
+	"smithy/pkg/agent"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// key and object written and removed again to verify permissions
+const initCheckName = "_smithy-init-check"
+
+type initCmd struct {
+	metaCommand
+	serverUrl string
+	credsPath string
+	replicas  int
+	history   uint
+	ttl       time.Duration
+	objTtl    time.Duration
+	timeout   time.Duration
+	// the optional stream keeping the agents' log lines
+	logStream   bool
+	logMaxAge   time.Duration
+	logMaxBytes int64
+}
+
+func initCommand() subcommands.Command {
+	return &initCmd{
+		metaCommand: metaCommand{
+			name:     "init",
+			synopsis: "create the smithy cluster bucket, object store and optionally the log stream, if they don't exist",
+			usage:    "init -server <url> -creds </path/to/file> [-replicas <int>] [-history <int>] [-ttl <duration>] [-obj-ttl <duration>] [-log-stream [-log-max-age <duration>] [-log-max-bytes <int>]]",
+		},
+	}
+}
+
+func (ic *initCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&ic.serverUrl, "server", nats.DefaultURL, "url of the command server")
+	f.StringVar(&ic.credsPath, "creds", "", "path to creds file")
+	f.IntVar(&ic.replicas, "replicas", 1, "number of replicas for the bucket and object store")
+	f.UintVar(&ic.history, "history", 10, "number of revisions kept per cluster record")
+	f.DurationVar(&ic.ttl, "ttl", 0, "how long cluster records are kept, 0 keeps them forever")
+	f.DurationVar(&ic.objTtl, "obj-ttl", 0, "how long server configs are kept, 0 keeps them forever")
+	f.BoolVar(&ic.logStream, "log-stream", false, "also create a stream keeping the agents' log lines, so the logs command can show past lines")
+	f.DurationVar(&ic.logMaxAge, "log-max-age", 24*time.Hour, "how long log lines are kept")
+	f.Int64Var(&ic.logMaxBytes, "log-max-bytes", 1<<30, "how many bytes of log lines are kept")
+	f.DurationVar(&ic.timeout, "t", time.Minute, "timeout duration")
+}
+
+func (ic *initCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+
+	if ic.history < 1 || ic.history > jetstream.KeyValueMaxHistory {
+		log.Printf("history must be between 1 and %d", jetstream.KeyValueMaxHistory)
+		return subcommands.ExitUsageError
+	}
+
+	initCtx, cancel := context.WithTimeout(ctx, ic.timeout)
+	defer cancel()
+
+	nc, err := connect(ic.serverUrl, ic.credsPath)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	defer nc.Close()
+
+	if err = ic.initBucket(initCtx, nc); err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	if err = ic.initObjectStore(nc); err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	if ic.logStream {
+		if err = ic.initLogStream(initCtx, nc); err != nil {
+			log.Println(err.Error())
+			return subcommands.ExitFailure
+		}
+	}
+
+	return subcommands.ExitSuccess
+}
+
+func (ic *initCmd) initBucket(ctx context.Context, nc *nats.Conn) error {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return err
+	}
+
+	kv, err := js.KeyValue(ctx, meta.SmithyClustersDataBucketName)
+	switch err {
+	case nil:
+		fmt.Printf("bucket %s already exists\n", meta.SmithyClustersDataBucketName)
+	case jetstream.ErrBucketNotFound:
+		kv, err = js.CreateKeyValue(ctx, jetstream.KeyValueConfig{
+			Bucket:      meta.SmithyClustersDataBucketName,
+			Description: "smithy agent cluster records",
+			History:     uint8(ic.history),
+			TTL:         ic.ttl,
+			Replicas:    ic.replicas,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to create bucket %s, %v", meta.SmithyClustersDataBucketName, err)
+		}
+		fmt.Printf("created bucket %s (replicas: %d, history: %d, ttl: %s)\n", meta.SmithyClustersDataBucketName, ic.replicas, ic.history, ic.ttl)
+	default:
+		return fmt.Errorf("unable to look up bucket %s, %v", meta.SmithyClustersDataBucketName, err)
+	}
+
+	// verify the creds allow everything the other commands do with the bucket
+	if _, err = kv.Put(ctx, initCheckName, []byte("ok")); err != nil {
+		return fmt.Errorf("unable to write to bucket %s, %v", meta.SmithyClustersDataBucketName, err)
+	}
+	if _, err = kv.Get(ctx, initCheckName); err != nil {
+		return fmt.Errorf("unable to read from bucket %s, %v", meta.SmithyClustersDataBucketName, err)
+	}
+	if err = kv.Purge(ctx, initCheckName); err != nil {
+		return fmt.Errorf("unable to delete from bucket %s, %v", meta.SmithyClustersDataBucketName, err)
+	}
+	fmt.Printf("verified read, write and delete access to bucket %s\n", meta.SmithyClustersDataBucketName)
+	return nil
+}
+
+func (ic *initCmd) initObjectStore(nc *nats.Conn) error {
+	jsObj, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+
+	obj, err := jsObj.ObjectStore(meta.SmithyClustersObjStoreName)
+	switch err {
+	case nil:
+		fmt.Printf("object store %s already exists\n", meta.SmithyClustersObjStoreName)
+	case nats.ErrStreamNotFound, nats.ErrBucketNotFound:
+		obj, err = jsObj.CreateObjectStore(&nats.ObjectStoreConfig{
+			Bucket:      meta.SmithyClustersObjStoreName,
+			Description: "smithy nats-server configs",
+			TTL:         ic.objTtl,
+			Replicas:    ic.replicas,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to create object store %s, %v", meta.SmithyClustersObjStoreName, err)
+		}
+		fmt.Printf("created object store %s (replicas: %d, ttl: %s)\n", meta.SmithyClustersObjStoreName, ic.replicas, ic.objTtl)
+	default:
+		return fmt.Errorf("unable to look up object store %s, %v", meta.SmithyClustersObjStoreName, err)
+	}
+
+	if _, err = obj.PutBytes(initCheckName, []byte("ok")); err != nil {
+		return fmt.Errorf("unable to write to object store %s, %v", meta.SmithyClustersObjStoreName, err)
+	}
+	if _, err = obj.GetBytes(initCheckName); err != nil {
+		return fmt.Errorf("unable to read from object store %s, %v", meta.SmithyClustersObjStoreName, err)
+	}
+	if err = obj.Delete(initCheckName); err != nil {
+		return fmt.Errorf("unable to delete from object store %s, %v", meta.SmithyClustersObjStoreName, err)
+	}
+	fmt.Printf("verified read, write and delete access to object store %s\n", meta.SmithyClustersObjStoreName)
+	return nil
+}
+
+func (ic *initCmd) initLogStream(ctx context.Context, nc *nats.Conn) error {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return err
+	}
+
+	_, err = js.Stream(ctx, agent.LogStreamName)
+	switch err {
+	case nil:
+		fmt.Printf("stream %s already exists\n", agent.LogStreamName)
+	case jetstream.ErrStreamNotFound:
+		_, err = js.CreateStream(ctx, jetstream.StreamConfig{
+			Name:        agent.LogStreamName,
+			Description: "smithy agent and nats-server log lines",
+			Subjects:    []string{agent.LogSubjects},
+			MaxAge:      ic.logMaxAge,
+			MaxBytes:    ic.logMaxBytes,
+			Discard:     jetstream.DiscardOld,
+			Replicas:    ic.replicas,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to create stream %s, %v", agent.LogStreamName, err)
+		}
+		fmt.Printf("created stream %s (replicas: %d, max age: %s, max bytes: %d)\n", agent.LogStreamName, ic.replicas, ic.logMaxAge, ic.logMaxBytes)
+	default:
+		return fmt.Errorf("unable to look up stream %s, %v", agent.LogStreamName, err)
+	}
+	return nil
+}
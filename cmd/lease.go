@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"smithy/pkg/cloud"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// leases live in the cluster bucket next to the clusters they guard
+const leaseKeyPrefix = "_lease."
+
+func leaseKey(clusterId string) string {
+	return leaseKeyPrefix + clusterId
+}
+
+// isClusterKey tells cluster entries apart from leases and other internal keys
+func isClusterKey(key string) bool {
+	return !strings.HasPrefix(key, "_")
+}
+
+// clusterLease is a lease acquired by this process
+type clusterLease struct {
+	*cloud.Lease
+	bucket    jetstream.KeyValue
+	clusterId string
+	revision  uint64
+}
+
+// acquireLease takes the lease of a cluster for an operation, it fails when
+// somebody else holds a lease that hasn't expired yet
+func acquireLease(ctx context.Context, bucket jetstream.KeyValue, clusterId string, operation string, ttl time.Duration) (*clusterLease, error) {
+	lease := cloud.NewLease(operation, ttl)
+	key := leaseKey(clusterId)
+
+	revision, err := bucket.Create(ctx, key, lease.Bytes())
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		// take over a lease its holder never released
+		var entry jetstream.KeyValueEntry
+		entry, err = bucket.Get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the lease of smithy cluster %s, %v", clusterId, err)
+		}
+		held, loadErr := cloud.LoadLease(entry.Value())
+		if loadErr == nil && !held.Expired(time.Now()) {
+			return nil, fmt.Errorf("cluster %s is %s", clusterId, held.Describe())
+		}
+		revision, err = bucket.Update(ctx, key, lease.Bytes(), entry.Revision())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to acquire the lease of smithy cluster %s, %v", clusterId, err)
+	}
+
+	return &clusterLease{
+		Lease:     lease,
+		bucket:    bucket,
+		clusterId: clusterId,
+		revision:  revision,
+	}, nil
+}
+
+// release gives the lease up, even when ctx is done
+func (l *clusterLease) release(ctx context.Context) {
+	releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), recordTimeout)
+	defer cancel()
+	if err := l.bucket.Delete(releaseCtx, leaseKey(l.clusterId), jetstream.LastRevision(l.revision)); err != nil {
+		log.Printf("unable to release the lease of smithy cluster %s, %v", l.clusterId, err)
+	}
+}
+
+// activeLeases returns the unexpired leases by cluster id
+func activeLeases(ctx context.Context, bucket jetstream.KeyValue, keys []string) map[string]*cloud.Lease {
+	leases := map[string]*cloud.Lease{}
+	now := time.Now()
+	for _, key := range keys {
+		if !strings.HasPrefix(key, leaseKeyPrefix) {
+			continue
+		}
+		entry, err := bucket.Get(ctx, key)
+		if err != nil {
+			continue
+		}
+		// unreadable leases are treated as held, they may guard something
+		lease, err := cloud.LoadLease(entry.Value())
+		if err != nil {
+			leases[strings.TrimPrefix(key, leaseKeyPrefix)] = &cloud.Lease{ExpiresAt: now.Add(time.Hour)}
+			continue
+		}
+		if !lease.Expired(now) {
+			leases[strings.TrimPrefix(key, leaseKeyPrefix)] = lease
+		}
+	}
+	return leases
+}
@@ -5,7 +5,10 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"smithy/internal/meta"
+	"smithy/pkg/cloud"
+	"text/tabwriter"
 
 	"github.com/google/subcommands"
 	"github.com/nats-io/nats.go"
@@ -35,19 +38,7 @@ func (ec *listCmd) SetFlags(f *flag.FlagSet) {
 
 func (ec *listCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
 
-	// --------------------
-	// HACK: pull out later
-
-	// default options
-	opts := []nats.Option{}
-
-	// if supplied a creds file, use it
-	if ec.credsPath != "" {
-		opts = append(opts, nats.UserCredentials(ec.credsPath))
-	}
-
-	// create NATS connection
-	nc, err := nats.Connect(ec.serverUrl, opts...)
+	nc, err := connect(ec.serverUrl, ec.credsPath)
 	if err != nil {
 		log.Println(err.Error())
 		return subcommands.ExitFailure
@@ -65,7 +56,6 @@ func (ec *listCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interfa
 		log.Println(err.Error())
 		return subcommands.ExitFailure
 	}
-	// --------------------
 
 	smithyClusterIds, err := smithyClustersDataBucket.Keys(ctx)
 	switch err {
@@ -79,9 +69,36 @@ func (ec *listCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interfa
 		return subcommands.ExitFailure
 	}
 
-	// print cluster ids
+	// print cluster ids along with their status and the operation running on them
+	leases := activeLeases(ctx, smithyClustersDataBucket, smithyClusterIds)
+	listed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
 	for _, smithyClusterId := range smithyClusterIds {
-		fmt.Println(smithyClusterId)
+		if !isClusterKey(smithyClusterId) {
+			continue
+		}
+		entry, err := smithyClustersDataBucket.Get(ctx, smithyClusterId)
+		if err == jetstream.ErrKeyNotFound {
+			// torn down since it was listed
+			continue
+		}
+		if err != nil {
+			log.Println(err.Error())
+			return subcommands.ExitFailure
+		}
+		status := "unreadable"
+		if agentCluster, err := cloud.LoadAgentCluster(entry.Value()); err == nil {
+			status = describeStatus(agentCluster)
+		}
+		if lease, ok := leases[smithyClusterId]; ok {
+			status += ", " + lease.Describe()
+		}
+		fmt.Fprintf(w, "%s\t%s\n", smithyClusterId, status)
+		listed++
+	}
+	w.Flush()
+	if listed == 0 {
+		fmt.Println("no smithy clusters found")
 	}
 
 	return subcommands.ExitSuccess
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"smithy/pkg/agent"
+	"syscall"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+type logsCmd struct {
+	metaCommand
+	serverUrl string
+	credsPath string
+	clusterId string
+	agentId   string
+	follow    bool
+	since     time.Duration
+}
+
+func logsCommand() subcommands.Command {
+	return &logsCmd{
+		metaCommand: metaCommand{
+			name:     "logs",
+			synopsis: "show the agent and nats-server logs of a smithy cluster's nodes",
+			usage:    "logs -id <string> -server <url> -creds </path/to/file> [-agent <string>] [-f] [-since <duration>]",
+		},
+	}
+}
+
+func (lc *logsCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&lc.clusterId, "id", "default", "smithy cluster id")
+	f.StringVar(&lc.serverUrl, "server", nats.DefaultURL, "url of the command server")
+	f.StringVar(&lc.credsPath, "creds", "", "path to creds file")
+	f.StringVar(&lc.agentId, "agent", "", "only show the logs of this agent (default: all agents of the cluster)")
+	f.BoolVar(&lc.follow, "f", false, "keep showing new lines")
+	f.DurationVar(&lc.since, "since", 0, "only show lines newer than this, 0 shows all kept lines")
+}
+
+func (lc *logsCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+
+	// follow until interrupted
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	nc, err := connect(lc.serverUrl, lc.credsPath)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	defer nc.Close()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+
+	agentId := lc.agentId
+	if agentId == "" {
+		agentId = "*"
+	}
+	subject := agent.LogSubject(lc.clusterId, agentId)
+
+	stream, err := js.Stream(ctx, agent.LogStreamName)
+	switch {
+	case err == jetstream.ErrStreamNotFound && lc.follow:
+		// only lines published from now on can be shown
+		if lc.since > 0 {
+			log.Printf("stream %s does not exist, -since is ignored", agent.LogStreamName)
+		}
+		err = lc.subscribe(ctx, nc, subject)
+	case err == jetstream.ErrStreamNotFound:
+		log.Printf("stream %s does not exist, run `%s init -log-stream` to keep log lines or use -f to follow them", agent.LogStreamName, Name)
+		return subcommands.ExitFailure
+	case err == nil:
+		err = lc.consume(ctx, stream, subject)
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+
+	return subcommands.ExitSuccess
+}
+
+// consume prints the kept lines in the order they were published, and the new
+// ones as well when following
+func (lc *logsCmd) consume(ctx context.Context, stream jetstream.Stream, subject string) error {
+	config := jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{subject},
+		DeliverPolicy:  jetstream.DeliverAllPolicy,
+	}
+	if lc.since > 0 {
+		startTime := time.Now().Add(-lc.since)
+		config.DeliverPolicy = jetstream.DeliverByStartTimePolicy
+		config.OptStartTime = &startTime
+	}
+	consumer, err := stream.OrderedConsumer(ctx, config)
+	if err != nil {
+		return err
+	}
+	if !lc.follow && consumer.CachedInfo().NumPending == 0 {
+		return nil
+	}
+
+	messages, err := consumer.Messages()
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		messages.Stop()
+	}()
+	for {
+		msg, err := messages.Next()
+		if err != nil {
+			return err
+		}
+		printLogLine(msg.Data())
+		if metadata, err := msg.Metadata(); err == nil && metadata.NumPending == 0 && !lc.follow {
+			messages.Stop()
+			return nil
+		}
+	}
+}
+
+// subscribe prints the lines published until ctx is done
+func (lc *logsCmd) subscribe(ctx context.Context, nc *nats.Conn, subject string) error {
+	sub, err := nc.Subscribe(subject, func(msg *nats.Msg) {
+		printLogLine(msg.Data)
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	<-ctx.Done()
+	return nil
+}
+
+// printLogLine prefixes a line with the agent and the log it comes from
+func printLogLine(data []byte) {
+	line := &agent.LogLine{}
+	if err := json.Unmarshal(data, line); err != nil {
+		return
+	}
+	fmt.Printf("[%s %s] %s\n", line.AgentId, line.Source, line.Line)
+}
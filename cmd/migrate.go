@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"smithy/internal/meta"
+	"smithy/pkg/cloud"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+type migrateCmd struct {
+	metaCommand
+	serverUrl string
+	credsPath string
+	dryRun    bool
+	timeout   time.Duration
+}
+
+func migrateCommand() subcommands.Command {
+	return &migrateCmd{
+		metaCommand: metaCommand{
+			name:     "migrate",
+			synopsis: fmt.Sprintf("rewrite all smithy cluster entries in schema version %d", cloud.AgentClusterSchemaVersion),
+			usage:    "migrate -server <url> -creds </path/to/file> [-dry-run]",
+		},
+	}
+}
+
+func (mc *migrateCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&mc.serverUrl, "server", nats.DefaultURL, "url of the command server")
+	f.StringVar(&mc.credsPath, "creds", "", "path to creds file")
+	f.BoolVar(&mc.dryRun, "dry-run", false, "only print which entries would be migrated")
+	f.DurationVar(&mc.timeout, "t", 5*time.Minute, "timeout duration")
+}
+
+func (mc *migrateCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+
+	migrateCtx, cancel := context.WithTimeout(ctx, mc.timeout)
+	defer cancel()
+
+	nc, err := connect(mc.serverUrl, mc.credsPath)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	defer nc.Close()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	smithyClustersDataBucket, err := js.KeyValue(migrateCtx, meta.SmithyClustersDataBucketName)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+
+	smithyClusterIds, err := smithyClustersDataBucket.Keys(migrateCtx)
+	switch err {
+	case jetstream.ErrNoKeysFound:
+		fmt.Println("no smithy clusters found")
+		return subcommands.ExitSuccess
+	case nil:
+		// continue
+	default:
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+
+	// keep going on errors, every entry that can be migrated should be
+	status := subcommands.ExitSuccess
+	for _, smithyClusterId := range smithyClusterIds {
+		if !isClusterKey(smithyClusterId) {
+			continue
+		}
+		if err = mc.migrate(migrateCtx, smithyClustersDataBucket, smithyClusterId); err != nil {
+			log.Printf("unable to migrate smithy cluster %s: %v", smithyClusterId, err)
+			status = subcommands.ExitFailure
+		}
+	}
+
+	return status
+}
+
+// migrate rewrites a cluster entry in the current schema version, if it isn't already
+func (mc *migrateCmd) migrate(ctx context.Context, smithyClustersDataBucket jetstream.KeyValue, clusterId string) error {
+	entry, err := smithyClustersDataBucket.Get(ctx, clusterId)
+	if err == jetstream.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	migrated, fromVersion, err := cloud.MigrateAgentCluster(entry.Value())
+	if err != nil {
+		return err
+	}
+	if fromVersion == cloud.AgentClusterSchemaVersion {
+		fmt.Printf("%s is up to date\n", clusterId)
+		return nil
+	}
+	if mc.dryRun {
+		fmt.Printf("%s would be migrated from schema version %d to %d\n", clusterId, fromVersion, cloud.AgentClusterSchemaVersion)
+		return nil
+	}
+
+	lease, err := acquireLease(ctx, smithyClustersDataBucket, clusterId, cloud.OperationMigrate, mc.timeout)
+	if err != nil {
+		return err
+	}
+	defer lease.release(ctx)
+
+	// fails if the entry changed since it was read
+	if _, err = smithyClustersDataBucket.Update(ctx, clusterId, migrated, entry.Revision()); err != nil {
+		return err
+	}
+	fmt.Printf("%s migrated from schema version %d to %d\n", clusterId, fromVersion, cloud.AgentClusterSchemaVersion)
+	return nil
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// connect creates a connection to the command server, using the creds file if supplied
+func connect(serverUrl string, credsPath string) (*nats.Conn, error) {
+	// default options
+	opts := []nats.Option{}
+
+	// if supplied a creds file, use it
+	if credsPath != "" {
+		opts = append(opts, nats.UserCredentials(credsPath))
+	}
+
+	return nats.Connect(serverUrl, opts...)
+}
+
+// serverNow asks the server for its current time, so the age of a server side
+// timestamp, like when a KV entry was written, doesn't depend on the local clock.
+// Servers before 2.10 don't tell the time, the local clock is used for them.
+func serverNow(ctx context.Context, nc *nats.Conn, streamName string) time.Time {
+	msg, err := nc.RequestWithContext(ctx, fmt.Sprintf("%sSTREAM.INFO.%s", jetstream.DefaultAPIPrefix, streamName), nil)
+	if err != nil {
+		return time.Now()
+	}
+	info := struct {
+		TimeStamp time.Time `json:"ts"`
+	}{}
+	if err = json.Unmarshal(msg.Data, &info); err != nil || info.TimeStamp.IsZero() {
+		return time.Now()
+	}
+	return info.TimeStamp
+}
+
+// kvStreamName is the stream backing a KV bucket
+func kvStreamName(bucket string) string {
+	return "KV_" + bucket
+}
@@ -0,0 +1,8 @@
+package cmd
+
+import (
+	// cloud providers register themselves with the cloud package on import
+	_ "smithy/pkg/aws"
+	_ "smithy/pkg/container"
+	_ "smithy/pkg/local"
+)
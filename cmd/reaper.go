@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"smithy/internal/meta"
+	"smithy/pkg/cloud"
+	"syscall"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+type reaperCmd struct {
+	metaCommand
+	serverUrl string
+	credsPath string
+	interval  time.Duration
+	once      bool
+	timeout   time.Duration
+}
+
+func reaperCommand() subcommands.Command {
+	return &reaperCmd{
+		metaCommand: metaCommand{
+			name:     "reaper",
+			synopsis: "watch the smithy clusters and tear down the ones whose ttl ran out",
+			usage:    "reaper -server <url> -creds </path/to/file> [-interval <duration>] [-once] [-t <duration>]",
+		},
+	}
+}
+
+func (rc *reaperCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&rc.serverUrl, "server", nats.DefaultURL, "url of the command server")
+	f.StringVar(&rc.credsPath, "creds", "", "path to creds file")
+	f.DurationVar(&rc.interval, "interval", 30*time.Second, "how often to check for expired clusters, failed teardowns are retried as often")
+	f.BoolVar(&rc.once, "once", false, "tear down the clusters that expired by now and exit, e.g. from cron")
+	f.DurationVar(&rc.timeout, "t", 10*time.Minute, "timeout duration of each teardown")
+}
+
+func (rc *reaperCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+
+	if rc.interval <= 0 {
+		log.Println("interval must be positive")
+		return subcommands.ExitUsageError
+	}
+
+	// finish the teardown in progress, then stop
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	nc, err := connect(rc.serverUrl, rc.credsPath)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	defer nc.Close()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	smithyClustersDataBucket, err := js.KeyValue(ctx, meta.SmithyClustersDataBucketName)
+	if err == jetstream.ErrBucketNotFound {
+		log.Printf("bucket %s does not exist, run `%s init` first", meta.SmithyClustersDataBucketName, Name)
+		return subcommands.ExitFailure
+	}
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+
+	// expiry of every cluster with a ttl, kept current by the watcher
+	expiries := map[string]time.Time{}
+
+	watcher, err := smithyClustersDataBucket.WatchAll(ctx)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	defer watcher.Stop()
+
+	ticker := time.NewTicker(rc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return subcommands.ExitSuccess
+		case entry, ok := <-watcher.Updates():
+			if !ok {
+				log.Printf("stopped watching bucket %s", meta.SmithyClustersDataBucketName)
+				return subcommands.ExitFailure
+			}
+			// nil marks the end of the initial values
+			if entry == nil {
+				if rc.once {
+					return rc.reap(ctx, nc, smithyClustersDataBucket, expiries)
+				}
+				rc.reap(ctx, nc, smithyClustersDataBucket, expiries)
+				continue
+			}
+			rc.track(expiries, entry)
+		case <-ticker.C:
+			rc.reap(ctx, nc, smithyClustersDataBucket, expiries)
+		}
+	}
+}
+
+// track records the expiry of a cluster entry, or forgets it
+func (rc *reaperCmd) track(expiries map[string]time.Time, entry jetstream.KeyValueEntry) {
+	clusterId := entry.Key()
+	delete(expiries, clusterId)
+	if entry.Operation() != jetstream.KeyValuePut || !isClusterKey(clusterId) {
+		return
+	}
+	agentCluster, err := cloud.LoadAgentCluster(entry.Value())
+	if err != nil {
+		log.Printf("skipping cluster %s: %v", clusterId, err)
+		return
+	}
+	if agentCluster.ExpiresAt != nil {
+		expiries[clusterId] = *agentCluster.ExpiresAt
+	}
+}
+
+// reap tears down every expired cluster, failures are left for the next run
+func (rc *reaperCmd) reap(ctx context.Context, nc *nats.Conn, smithyClustersDataBucket jetstream.KeyValue, expiries map[string]time.Time) subcommands.ExitStatus {
+	status := subcommands.ExitSuccess
+	now := time.Now()
+	for clusterId, expiresAt := range expiries {
+		if now.Before(expiresAt) || ctx.Err() != nil {
+			continue
+		}
+		if err := rc.reapCluster(ctx, nc, smithyClustersDataBucket, clusterId); err != nil {
+			log.Printf("unable to tear down expired cluster %s: %v", clusterId, err)
+			status = subcommands.ExitFailure
+			continue
+		}
+		delete(expiries, clusterId)
+	}
+	return status
+}
+
+func (rc *reaperCmd) reapCluster(ctx context.Context, nc *nats.Conn, smithyClustersDataBucket jetstream.KeyValue, clusterId string) error {
+	teardownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rc.timeout)
+	defer cancel()
+
+	lease, err := acquireLease(teardownCtx, smithyClustersDataBucket, clusterId, cloud.OperationTeardown, rc.timeout+recordTimeout)
+	if err != nil {
+		return err
+	}
+	defer lease.release(ctx)
+
+	// the cluster may have been extended or torn down since it was last seen
+	record, err := getClusterRecord(teardownCtx, smithyClustersDataBucket, clusterId)
+	if err == jetstream.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !record.Expired(time.Now()) {
+		return nil
+	}
+
+	log.Printf("smithy cluster %s expired at %s, tearing it down", clusterId, record.ExpiresAt.Local().Format(time.RFC3339))
+	if err = teardownCluster(teardownCtx, nc, rc.serverUrl, record); err != nil {
+		return err
+	}
+	log.Printf("tore down expired smithy cluster %s", clusterId)
+	return nil
+}
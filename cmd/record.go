@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"smithy/pkg/cloud"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// how long writing a status after a failure may take, it doesn't run on the
+// (possibly expired) context of the failed operation
+const recordTimeout = time.Minute
+
+// clusterRecord is a cluster entry along with the revision it was last read or
+// written at, every write fails if somebody else changed the entry in between
+type clusterRecord struct {
+	*cloud.AgentCluster
+	bucket    jetstream.KeyValue
+	clusterId string
+	revision  uint64
+}
+
+// createClusterRecord stores a new cluster entry, failing with jetstream.ErrKeyExists
+// if the cluster id is taken
+func createClusterRecord(ctx context.Context, bucket jetstream.KeyValue, clusterId string, agentCluster *cloud.AgentCluster) (*clusterRecord, error) {
+	revision, err := bucket.Create(ctx, clusterId, agentCluster.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &clusterRecord{
+		AgentCluster: agentCluster,
+		bucket:       bucket,
+		clusterId:    clusterId,
+		revision:     revision,
+	}, nil
+}
+
+// getClusterRecord reads a cluster entry, failing with jetstream.ErrKeyNotFound if
+// there is none
+func getClusterRecord(ctx context.Context, bucket jetstream.KeyValue, clusterId string) (*clusterRecord, error) {
+	entry, err := bucket.Get(ctx, clusterId)
+	if err != nil {
+		return nil, err
+	}
+	agentCluster, err := cloud.LoadAgentCluster(entry.Value())
+	if err != nil {
+		return nil, fmt.Errorf("unable to read smithy cluster %s, %v", clusterId, err)
+	}
+	return &clusterRecord{
+		AgentCluster: agentCluster,
+		bucket:       bucket,
+		clusterId:    clusterId,
+		revision:     entry.Revision(),
+	}, nil
+}
+
+// save writes the entry back
+func (r *clusterRecord) save(ctx context.Context) error {
+	revision, err := r.bucket.Update(ctx, r.clusterId, r.Bytes(), r.revision)
+	if err != nil {
+		return fmt.Errorf("unable to update smithy cluster %s, %v", r.clusterId, err)
+	}
+	r.revision = revision
+	return nil
+}
+
+// setStatus moves the cluster to a status and saves it
+func (r *clusterRecord) setStatus(ctx context.Context, status cloud.Status, statusErr error) error {
+	r.SetStatus(status, statusErr)
+	return r.save(ctx)
+}
+
+// setHealth moves a running cluster to degraded when some of its nodes are
+// unhealthy and back to running once none are, unhealthy tells which nodes
+// aren't and why. Other statuses belong to the operations that set them, as
+// does the entry while an operation holds the cluster's lease.
+func (r *clusterRecord) setHealth(ctx context.Context, unhealthy []string) (bool, error) {
+	var status cloud.Status
+	var statusErr error
+	switch {
+	case r.Status == cloud.StatusRunning && len(unhealthy) > 0:
+		status, statusErr = cloud.StatusDegraded, fmt.Errorf("unhealthy nodes: %s", strings.Join(unhealthy, ", "))
+	case r.Status == cloud.StatusDegraded && len(unhealthy) == 0:
+		status = cloud.StatusRunning
+	default:
+		return false, nil
+	}
+	if leases := activeLeases(ctx, r.bucket, []string{leaseKey(r.clusterId)}); len(leases) > 0 {
+		return false, nil
+	}
+	return true, r.setStatus(ctx, status, statusErr)
+}
+
+// fail saves the cluster as failed, even when ctx is done
+func (r *clusterRecord) fail(ctx context.Context, failure error) error {
+	failCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), recordTimeout)
+	defer cancel()
+	return r.setStatus(failCtx, cloud.StatusFailed, failure)
+}
+
+// delete removes the entry
+func (r *clusterRecord) delete(ctx context.Context) error {
+	if err := r.bucket.Delete(ctx, r.clusterId, jetstream.LastRevision(r.revision)); err != nil {
+		return fmt.Errorf("unable to delete smithy cluster %s, %v", r.clusterId, err)
+	}
+	return nil
+}
+
+// describeStatus is e.g. "running since 2023-12-18T10:02:03+01:00"
+func describeStatus(agentCluster *cloud.AgentCluster) string {
+	since := agentCluster.StatusSince()
+	if since.IsZero() {
+		return string(agentCluster.Status)
+	}
+	return fmt.Sprintf("%s since %s", agentCluster.Status, since.Local().Format(time.RFC3339))
+}
@@ -63,13 +63,27 @@ func Run(args []string) int {
 	cmdr := subcommands.NewCommander(rootFs, Name)
 
 	commandsMap := map[string][]subcommands.Command{
+		"setup": {
+			initCommand(),
+			gcCommand(),
+			migrateCommand(),
+		},
 		"managing agents": {
 			deployAgentsCommand(),
 			teardownAgentsCommand(),
+			extendCommand(),
+			reaperCommand(),
 			listCommand(),
 			getInfoCommand(),
+			statusCommand(),
+			logsCommand(),
+			execCommand(),
+			collectCommand(),
 			startAgentCommand(),
 			startNatsCommand(),
+			stopNatsCommand(),
+			restartNatsCommand(),
+			reloadNatsCommand(),
 		},
 		"help": {
 			//versionCommand(),
@@ -4,7 +4,10 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
 	"smithy/pkg/agent"
+	"syscall"
 
 	"github.com/google/subcommands"
 	"github.com/nats-io/nats.go"
@@ -14,8 +17,10 @@ type startAgentCmd struct {
 	metaCommand
 	serverUrl string
 	credsPath string
-	clusterId  string
+	clusterId string
 	agentId   string
+	agentOpts agent.Options
+	execAllow string
 }
 
 func startAgentCommand() subcommands.Command {
@@ -23,7 +28,7 @@ func startAgentCommand() subcommands.Command {
 		metaCommand: metaCommand{
 			name:     "start-agent",
 			synopsis: "Starts agent process",
-			usage:    "start-agent -server <url> -creds <path/to/file> -cluster <string> -id <string>",
+			usage:    "start-agent -server <url> -creds <path/to/file> -cluster <string> -id <string> [-workdir <path>] [-client-port <int>] [-cluster-port <int>] [-monitor-port <int>] [-max-restarts <int>] [-restart-backoff <duration>] [-max-restart-backoff <duration>] [-stream-logs=false] [-agent-log <path>] [-exec-allow <program,program,...>]",
 		},
 	}
 }
@@ -33,6 +38,16 @@ func (c *startAgentCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&c.credsPath, "creds", "", "Credentials file path")
 	f.StringVar(&c.clusterId, "cluster", "default", "Smithy instance id")
 	f.StringVar(&c.agentId, "id", "", "Agent id")
+	f.StringVar(&c.agentOpts.WorkDir, "workdir", "", "Directory for the server config, data and log (default $HOME)")
+	f.IntVar(&c.agentOpts.ClientPort, "client-port", 0, "Override the nats-server client port")
+	f.IntVar(&c.agentOpts.ClusterPort, "cluster-port", 0, "Override the nats-server cluster port")
+	f.IntVar(&c.agentOpts.MonitorPort, "monitor-port", 0, "Override the nats-server http monitoring port")
+	f.IntVar(&c.agentOpts.MaxRestarts, "max-restarts", agent.DefaultMaxRestarts, "How often to restart nats-server when it exits on its own, 0 disables restarts")
+	f.DurationVar(&c.agentOpts.RestartBackoff, "restart-backoff", agent.DefaultRestartBackoff, "Delay before the first restart, it doubles with every restart")
+	f.DurationVar(&c.agentOpts.MaxRestartBackoff, "max-restart-backoff", agent.DefaultMaxRestartBackoff, "Maximum delay between restarts")
+	f.BoolVar(&c.agentOpts.StreamLogs, "stream-logs", true, "Publish the agent and nats-server log lines for the logs command")
+	f.StringVar(&c.agentOpts.AgentLogFile, "agent-log", "", "The agent's log file (default: the file stdout is redirected to)")
+	f.StringVar(&c.execAllow, "exec-allow", "", "Comma separated programs the exec command may run with any arguments, e.g. "+agent.SuggestedExecAllow+" (default: exec is disabled)")
 }
 
 func (c *startAgentCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
@@ -41,8 +56,14 @@ func (c *startAgentCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...in
 		return subcommands.ExitFailure
 	}
 
+	c.agentOpts.ExecAllow = agent.ParseExecAllow(c.execAllow)
+
+	// stop the agent, and with it nats-server, when asked to terminate
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// create agent
-	agent, err := agent.New(c.serverUrl, c.credsPath, c.clusterId, c.agentId)
+	agent, err := agent.New(c.serverUrl, c.credsPath, c.clusterId, c.agentId, c.agentOpts)
 	if err != nil {
 		fmt.Println(err)
 		return subcommands.ExitFailure
@@ -4,25 +4,36 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"os"
+	"smithy/internal/meta"
 	"smithy/pkg/agent"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/google/subcommands"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 )
 
 type startNatsCmd struct {
 	metaCommand
-	serverUrl string
-	credsPath string
-	clusterId string
+	serverUrl   string
+	credsPath   string
+	clusterId   string
+	agentIds    agentIdsFlag
+	timeout     time.Duration
+	wait        bool
+	waitTimeout time.Duration
 }
 
 func startNatsCommand() subcommands.Command {
-	return &startAgentCmd{
+	return &startNatsCmd{
 		metaCommand: metaCommand{
 			name:     "start-nats",
 			synopsis: "Starts nats-server process for a cluster",
-			usage:    "start-nats -server <url> -creds <path/to/file> -cluster <string>",
+			usage:    "start-nats -server <url> -creds <path/to/file> -id <string> [-agents <id,id,...>] [-t <duration>] [-wait [-wait-timeout <duration>]]",
 		},
 	}
 }
@@ -30,29 +41,252 @@ func startNatsCommand() subcommands.Command {
 func (c *startNatsCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&c.serverUrl, "server", nats.DefaultURL, "Server URL")
 	f.StringVar(&c.credsPath, "creds", "", "Credentials file path")
-	f.StringVar(&c.clusterId, "cluster", "default", "Smithy instance id")
+	f.StringVar(&c.clusterId, "id", "default", "Smithy cluster id")
+	f.StringVar(&c.clusterId, "cluster", "default", "Deprecated alias of -id")
+	f.Var(&c.agentIds, "agents", "Comma separated ids of the agents to start (default: all agents of the cluster)")
+	f.DurationVar(&c.timeout, "t", 10*time.Second, "How long to wait for the agents to reply")
+	f.BoolVar(&c.wait, "wait", false, "Wait until every node of the cluster, not only the started ones, is healthy, routed to all peers and JetStream elected a meta leader")
+	f.DurationVar(&c.waitTimeout, "wait-timeout", 2*time.Minute, "How long to wait for the cluster to form")
 }
 
 func (c *startNatsCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
 
-	opts := []nats.Option{}
-
-	if c.credsPath != "" {
-		opts = append(opts, nats.UserCredentials(c.credsPath))
-	}
+	startCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
 
 	fmt.Println("Connecting to NATS server")
 
-	nc, err := nats.Connect(c.serverUrl, opts...)
+	nc, err := connect(c.serverUrl, c.credsPath)
 	if err != nil {
 		fmt.Println(err)
 		return subcommands.ExitFailure
 	}
+	defer nc.Close()
 	fmt.Println("Connected to NATS server")
-	if err = nc.Publish(fmt.Sprintf("%s.%s", agent.SmithyAgentsStreamName, c.clusterId), []byte("start")); err != nil {
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	smithyClustersDataBucket, err := js.KeyValue(startCtx, meta.SmithyClustersDataBucketName)
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	// don't publish to agents that can't exist
+	record, err := getClusterRecord(startCtx, smithyClustersDataBucket, c.clusterId)
+	switch err {
+	case nil:
+		// continue
+	case jetstream.ErrKeyNotFound:
+		fmt.Printf("smithy cluster id: %s does not exist\n", c.clusterId)
+		return subcommands.ExitFailure
+	default:
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	if unknown := c.unknownAgentIds(record); len(unknown) > 0 {
+		fmt.Printf("smithy cluster %s has no agents %s\n", c.clusterId, strings.Join(unknown, ","))
+		return subcommands.ExitUsageError
+	}
+
+	command, err := agent.NewCommand(agent.CommandStart, c.agentIds, nil)
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	// heartbeats count once their revision is past the bucket's before the start,
+	// unlike their times revisions don't depend on the clocks of the agents
+	var startRevision uint64
+	if c.wait {
+		if startRevision, err = heartbeatRevision(startCtx, js, c.clusterId); err != nil {
+			fmt.Println(err)
+			return subcommands.ExitFailure
+		}
+	}
+	replies, expected, err := sendAgentCommand(startCtx, nc, c.clusterId, command)
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	var status subcommands.ExitStatus
+	if len(replies) == 0 && len(c.agentIds) == 0 {
+		// agents of older smithy releases only understand the bare command and never
+		// reply, so their silence isn't a failure, -wait tells whether they started
+		if err = nc.Publish(agent.CommandSubject(c.clusterId), []byte(agent.CommandStart)); err != nil {
+			fmt.Println(err)
+			return subcommands.ExitFailure
+		}
+		fmt.Println("no agent replied, sent the legacy start to agents of older smithy releases, they don't reply")
+		status = subcommands.ExitSuccess
+	} else {
+		status = reportReplies(replies, expected, describePid("started"))
+	}
+	if !c.wait {
+		return status
+	}
+
+	// wait even when agents failed, the cluster shows what that means for it
+	waitCtx, cancel := context.WithTimeout(ctx, c.waitTimeout)
+	defer cancel()
+	pending, err := c.waitForCluster(waitCtx, js, record, startRevision)
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	// a running cluster that didn't form is degraded, one that did no longer is
+	unhealthy := []string{}
+	for agentId, reason := range pending {
+		unhealthy = append(unhealthy, fmt.Sprintf("%s %s", agentId, reason))
+	}
+	sort.Strings(unhealthy)
+	recordCtx, cancel := context.WithTimeout(ctx, recordTimeout)
+	defer cancel()
+	if changed, err := record.setHealth(recordCtx, unhealthy); err != nil {
 		fmt.Println(err)
+	} else if changed {
+		fmt.Printf("smithy cluster %s is %s\n", c.clusterId, record.Status)
+	}
+
+	if len(pending) > 0 {
+		fmt.Printf("smithy cluster %s did not form in time\n", c.clusterId)
 		return subcommands.ExitFailure
 	}
+	return status
+}
+
+// unknownAgentIds returns the agents asked for that the cluster doesn't record,
+// none for clusters that don't record their agent ids
+func (c *startNatsCmd) unknownAgentIds(record *clusterRecord) []string {
+	recorded := map[string]bool{}
+	for _, ci := range record.ComputeInstances {
+		if ci.AgentId == "" {
+			return nil
+		}
+		recorded[ci.AgentId] = true
+	}
+	unknown := []string{}
+	for _, agentId := range c.agentIds {
+		if !recorded[agentId] {
+			unknown = append(unknown, agentId)
+		}
+	}
+	return unknown
+}
+
+// waitForCluster watches the agents' heartbeats until every node of the cluster
+// reported ready in a heartbeat past startRevision. When ctx is done first it prints why
+// nodes aren't and returns them along with the reasons.
+func (c *startNatsCmd) waitForCluster(ctx context.Context, js jetstream.JetStream, record *clusterRecord, startRevision uint64) (map[string]string, error) {
+	// why each node isn't ready yet, nodes are removed once they are
+	pending := map[string]string{}
+	for _, ci := range record.ComputeInstances {
+		if ci.AgentId == "" {
+			return nil, fmt.Errorf("smithy cluster %s doesn't record its agent ids, unable to wait for it", c.clusterId)
+		}
+		pending[ci.AgentId] = "no heartbeat since start"
+	}
+	peers := len(record.ComputeInstances) - 1
+
+	heartbeatBucket, err := agent.HeartbeatBucket(ctx, js, c.clusterId)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := heartbeatBucket.WatchAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer watcher.Stop()
+
+	fmt.Printf("waiting for %d nodes to form the cluster\n", len(pending))
+	for len(pending) > 0 {
+		var entry jetstream.KeyValueEntry
+		select {
+		case entry = <-watcher.Updates():
+		case <-ctx.Done():
+			reportPending(pending)
+			return pending, nil
+		}
+		// nil marks the end of the initial values
+		if entry == nil || entry.Operation() != jetstream.KeyValuePut {
+			continue
+		}
+		if _, ok := pending[entry.Key()]; !ok || entry.Revision() <= startRevision {
+			continue
+		}
+		heartbeat, err := agent.LoadHeartbeat(entry.Value())
+		if err != nil {
+			pending[entry.Key()] = fmt.Sprintf("unreadable heartbeat, %v", err)
+			continue
+		}
+		if reason := notReady(heartbeat, peers); reason != "" {
+			pending[entry.Key()] = reason
+			continue
+		}
+		fmt.Printf("%s is ready\n", entry.Key())
+		delete(pending, entry.Key())
+	}
 
-	return subcommands.ExitSuccess
+	fmt.Println("nats urls:")
+	clientUrls := []string{}
+	for _, ci := range record.ComputeInstances {
+		clientUrls = append(clientUrls, ci.ClientUrl())
+	}
+	fmt.Println(strings.Join(clientUrls, ","))
+	return pending, nil
+}
+
+// heartbeatRevision is the latest revision of the cluster's heartbeat bucket
+func heartbeatRevision(ctx context.Context, js jetstream.JetStream, clusterId string) (uint64, error) {
+	// older deployments don't have the bucket until their agents started
+	if _, err := agent.HeartbeatBucket(ctx, js, clusterId); err != nil {
+		return 0, err
+	}
+	stream, err := js.Stream(ctx, kvStreamName(agent.HeartbeatBucketName(clusterId)))
+	if err != nil {
+		return 0, err
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return info.State.LastSeq, nil
+}
+
+// notReady tells why a node isn't part of a fully formed cluster, empty if it is
+func notReady(heartbeat *agent.Heartbeat, peers int) string {
+	health := heartbeat.Health
+	switch {
+	case heartbeat.ServerState != agent.ServerRunning:
+		return fmt.Sprintf("nats-server %s", heartbeat.ServerState)
+	case health == nil:
+		return "nats-server health unknown, is monitoring enabled?"
+	case !health.Ready:
+		return fmt.Sprintf("nats-server not ready: %s", health.Error)
+	case health.Routes < peers:
+		return fmt.Sprintf("routes to %d of %d peers %v", health.Routes, peers, health.Peers)
+	case !health.JetStream:
+		return "jetstream disabled"
+	case health.MetaLeader == "":
+		return "no jetstream meta leader"
+	}
+	return ""
+}
+
+// reportPending prints why nodes aren't ready
+func reportPending(pending map[string]string) {
+	agentIds := []string{}
+	for agentId := range pending {
+		agentIds = append(agentIds, agentId)
+	}
+	sort.Strings(agentIds)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, agentId := range agentIds {
+		fmt.Fprintf(w, "%s\tnot ready\t%s\n", agentId, pending[agentId])
+	}
+	w.Flush()
 }
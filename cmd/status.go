@@ -0,0 +1,261 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"smithy/internal/meta"
+	"smithy/pkg/agent"
+	"smithy/pkg/cloud"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// agent states shown by status
+const (
+	agentUp            = "up"
+	agentStale         = "stale"
+	agentNeverReported = "never reported"
+)
+
+type statusCmd struct {
+	metaCommand
+	serverUrl string
+	credsPath string
+	clusterId string
+	timeout   time.Duration
+}
+
+func statusCommand() subcommands.Command {
+	return &statusCmd{
+		metaCommand: metaCommand{
+			name:     "status",
+			synopsis: "show which agents of a smithy cluster are up, stale or never reported, and mark it degraded while some aren't healthy",
+			usage:    "status -id <string> -server <url> -creds </path/to/file>",
+		},
+	}
+}
+
+func (sc *statusCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&sc.clusterId, "id", "default", "smithy cluster id")
+	f.StringVar(&sc.serverUrl, "server", nats.DefaultURL, "url of the command server")
+	f.StringVar(&sc.credsPath, "creds", "", "path to creds file")
+	f.DurationVar(&sc.timeout, "t", 30*time.Second, "timeout duration")
+}
+
+// agentStatus is a node of the cluster along with its last heartbeat, if any
+type agentStatus struct {
+	agentId    string
+	instanceId string
+	heartbeat  *agent.Heartbeat
+	lastSeen   time.Time
+}
+
+func (s *agentStatus) state(now time.Time) string {
+	switch {
+	case s.heartbeat == nil:
+		return agentNeverReported
+	case now.Sub(s.lastSeen) > agent.HeartbeatStaleAfter:
+		return agentStale
+	default:
+		return agentUp
+	}
+}
+
+// unhealthy tells why the node is unhealthy, empty if it isn't. A stopped
+// nats-server is what the operator asked for.
+func (s *agentStatus) unhealthy(now time.Time) string {
+	if state := s.state(now); state != agentUp {
+		return state
+	}
+	switch s.heartbeat.ServerState {
+	case agent.ServerRestarting, agent.ServerGaveUp:
+		return "nats-server " + s.heartbeat.ServerState
+	case agent.ServerRunning:
+		if health := s.heartbeat.Health; health != nil && !health.Ready {
+			return "nats-server not ready"
+		}
+	}
+	return ""
+}
+
+func (sc *statusCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+
+	statusCtx, cancel := context.WithTimeout(ctx, sc.timeout)
+	defer cancel()
+
+	nc, err := connect(sc.serverUrl, sc.credsPath)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	defer nc.Close()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	smithyClustersDataBucket, err := js.KeyValue(statusCtx, meta.SmithyClustersDataBucketName)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+
+	record, err := getClusterRecord(statusCtx, smithyClustersDataBucket, sc.clusterId)
+	switch err {
+	case nil:
+		// continue
+	case jetstream.ErrKeyNotFound:
+		log.Printf("smithy cluster id: %s does not exist", sc.clusterId)
+		return subcommands.ExitFailure
+	default:
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+
+	// one row per recorded node, agents that report without being recorded are
+	// shown as well
+	statuses := []*agentStatus{}
+	byAgentId := map[string]*agentStatus{}
+	for _, ci := range record.ComputeInstances {
+		status := &agentStatus{agentId: ci.AgentId, instanceId: ci.InstanceId}
+		statuses = append(statuses, status)
+		if ci.AgentId != "" {
+			byAgentId[ci.AgentId] = status
+		}
+	}
+
+	heartbeats, err := sc.heartbeats(statusCtx, js)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	for _, entry := range heartbeats {
+		heartbeat, err := agent.LoadHeartbeat(entry.Value())
+		if err != nil {
+			log.Printf("unable to read heartbeat of agent %s, %v", entry.Key(), err)
+			continue
+		}
+		status, ok := byAgentId[heartbeat.AgentId]
+		if !ok {
+			status = &agentStatus{agentId: heartbeat.AgentId}
+			statuses = append(statuses, status)
+		}
+		status.heartbeat = heartbeat
+		// the server's clock, agents' clocks may be off
+		status.lastSeen = entry.Created()
+	}
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return statuses[i].agentId < statuses[j].agentId
+	})
+
+	// heartbeats are timed by the server, so is their age
+	now := serverNow(statusCtx, nc, kvStreamName(agent.HeartbeatBucketName(sc.clusterId)))
+
+	// running clusters with unhealthy nodes are degraded
+	unhealthy := []string{}
+	for _, status := range statuses {
+		if reason := status.unhealthy(now); reason != "" {
+			node := status.agentId
+			if node == "" {
+				node = status.instanceId
+			}
+			unhealthy = append(unhealthy, fmt.Sprintf("%s %s", node, reason))
+		}
+	}
+	if _, err = record.setHealth(statusCtx, unhealthy); err != nil {
+		// somebody else changed the entry, the status shown may be outdated
+		log.Println(err.Error())
+	}
+
+	fmt.Printf("smithy cluster %s: %s\n", sc.clusterId, describeStatus(record.AgentCluster))
+	if record.Status == cloud.StatusDegraded && record.LastError != "" {
+		fmt.Println(record.LastError)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "AGENT\tINSTANCE\tSTATE\tLAST SEEN\tUPTIME\tNATS-SERVER\tHEALTH\tVERSION")
+	for _, status := range statuses {
+		agentId, instanceId := status.agentId, status.instanceId
+		if agentId == "" {
+			agentId = "-"
+		}
+		if instanceId == "" {
+			instanceId = "-"
+		}
+		if status.heartbeat == nil {
+			fmt.Fprintf(w, "%s\t%s\t%s\t-\t-\t-\t-\t-\n", agentId, instanceId, status.state(now))
+			continue
+		}
+		server := status.heartbeat.ServerState
+		if status.heartbeat.ServerPid != 0 {
+			server = fmt.Sprintf("%s (pid %d)", server, status.heartbeat.ServerPid)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s ago\t%s\t%s\t%s\t%s\n", agentId, instanceId, status.state(now),
+			now.Sub(status.lastSeen).Round(time.Second), status.heartbeat.Uptime, server,
+			describeHealth(status.heartbeat.Health), status.heartbeat.Version)
+	}
+	w.Flush()
+
+	return subcommands.ExitSuccess
+}
+
+// describeHealth summarizes what an agent polled from its nats-server
+func describeHealth(health *agent.ServerHealth) string {
+	if health == nil {
+		return "-"
+	}
+	if !health.Ready {
+		return fmt.Sprintf("not ready: %s", health.Error)
+	}
+	description := fmt.Sprintf("ready, %d routes", health.Routes)
+	switch {
+	case !health.JetStream:
+		description += ", jetstream disabled"
+	case health.MetaLeader == "":
+		description += ", no meta leader"
+	default:
+		description += ", meta leader " + health.MetaLeader
+	}
+	return description
+}
+
+// heartbeats returns the latest heartbeat of every agent that reported, the
+// bucket is missing until the first agent reported
+func (sc *statusCmd) heartbeats(ctx context.Context, js jetstream.JetStream) ([]jetstream.KeyValueEntry, error) {
+	heartbeatBucket, err := js.KeyValue(ctx, agent.HeartbeatBucketName(sc.clusterId))
+	if err == jetstream.ErrBucketNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := heartbeatBucket.Keys(ctx)
+	if err == jetstream.ErrNoKeysFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []jetstream.KeyValueEntry{}
+	for _, key := range keys {
+		entry, err := heartbeatBucket.Get(ctx, key)
+		if err == jetstream.ErrKeyNotFound {
+			// expired since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
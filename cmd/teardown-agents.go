@@ -3,10 +3,9 @@ package cmd
 import (
 	"context"
 	"flag"
-	"fmt"
 	"log"
 	"smithy/internal/meta"
-	"smithy/pkg/aws"
+	"smithy/pkg/agent"
 	"smithy/pkg/cloud"
 	"time"
 
@@ -15,16 +14,12 @@ import (
 	"github.com/nats-io/nats.go/jetstream"
 )
 
-type Terminator interface {
-	DeleteSecurityGroup(ctx context.Context, securityGroupId string) error
-	TerminateComputeInstances(ctx context.Context, instanceIds []string) error
-}
-
 type teardownAgentsCmd struct {
 	metaCommand
 	clusterId string
 	serverUrl string
 	credsPath string
+	provider  string
 	timeout   time.Duration
 }
 
@@ -33,7 +28,7 @@ func teardownAgentsCommand() subcommands.Command {
 		metaCommand: metaCommand{
 			name:     "teardown-agents",
 			synopsis: "terminate all agents for a given id",
-			usage:    "teardown-agents -id <string> -t <duration> -server <url> -creds </path/to/file>",
+			usage:    "teardown-agents -id <string> -t <duration> -server <url> -creds </path/to/file> [-provider <string>]",
 		},
 	}
 }
@@ -42,6 +37,7 @@ func (tac *teardownAgentsCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&tac.clusterId, "id", "default", "smithy cluster id")
 	f.StringVar(&tac.serverUrl, "server", nats.DefaultURL, "url to command server")
 	f.StringVar(&tac.credsPath, "creds", "", "path to creds file")
+	f.StringVar(&tac.provider, "provider", "", "cloud provider, must match the provider the cluster was deployed with (default: the recorded provider)")
 	f.DurationVar(&tac.timeout, "t", 10*time.Minute, "timeout duration")
 }
 
@@ -51,19 +47,7 @@ func (ec *teardownAgentsCmd) Execute(ctx context.Context, f *flag.FlagSet, args
 	teardownCtx, cancel := context.WithTimeout(ctx, ec.timeout)
 	defer cancel()
 
-	// --------------------
-	// HACK: pull out later
-
-	// default options
-	opts := []nats.Option{}
-
-	// if supplied a creds file, use it
-	if ec.credsPath != "" {
-		opts = append(opts, nats.UserCredentials(ec.credsPath))
-	}
-
-	// create NATS connection
-	nc, err := nats.Connect(ec.serverUrl, opts...)
+	nc, err := connect(ec.serverUrl, ec.credsPath)
 	if err != nil {
 		log.Println(err.Error())
 		return subcommands.ExitFailure
@@ -81,8 +65,22 @@ func (ec *teardownAgentsCmd) Execute(ctx context.Context, f *flag.FlagSet, args
 		log.Println(err.Error())
 		return subcommands.ExitFailure
 	}
-	// check if clusterId already exists
-	agentClusterEntry, err := smithyClustersDataBucket.Get(teardownCtx, ec.clusterId)
+	// don't leave a lease behind for a cluster that doesn't exist
+	if _, err = getClusterRecord(teardownCtx, smithyClustersDataBucket, ec.clusterId); err == jetstream.ErrKeyNotFound {
+		log.Printf("smithy cluster id: %s does not exist", ec.clusterId)
+		return subcommands.ExitFailure
+	}
+
+	// only one operation may run on a cluster at a time
+	lease, err := acquireLease(teardownCtx, smithyClustersDataBucket, ec.clusterId, cloud.OperationTeardown, ec.timeout+recordTimeout)
+	if err != nil {
+		log.Println(err.Error())
+		return subcommands.ExitFailure
+	}
+	defer lease.release(ctx)
+
+	// read again under the lease, it may have changed in the meantime
+	record, err := getClusterRecord(teardownCtx, smithyClustersDataBucket, ec.clusterId)
 	switch err {
 	case nil:
 		// continue
@@ -94,18 +92,46 @@ func (ec *teardownAgentsCmd) Execute(ctx context.Context, f *flag.FlagSet, args
 		return subcommands.ExitFailure
 	}
 
-	agentCluster, err := cloud.LoadAgentCluster(agentClusterEntry.Value())
-	if err != nil {
+	// always tear down with the backend that created the cluster
+	if ec.provider != "" && ec.provider != record.Provider {
+		log.Printf("smithy cluster %s was deployed with provider %s, not %s", ec.clusterId, record.Provider, ec.provider)
+		return subcommands.ExitUsageError
+	}
+
+	if err = teardownCluster(teardownCtx, nc, ec.serverUrl, record); err != nil {
 		log.Println(err.Error())
 		return subcommands.ExitFailure
 	}
-	// --------------------
 
-	var teardowner Terminator
-	teardowner, err = aws.New(teardownCtx)
+	return subcommands.ExitSuccess
+}
+
+// teardownCluster removes the resources of a cluster with the provider that
+// created it, then its entry and config. A cluster that can't be torn down is
+// left as failed.
+func teardownCluster(ctx context.Context, nc *nats.Conn, serverUrl string, record *clusterRecord) error {
+	if err := record.setStatus(ctx, cloud.StatusTearingDown, nil); err != nil {
+		return err
+	}
+	if err := removeCluster(ctx, nc, serverUrl, record); err != nil {
+		if failErr := record.fail(ctx, err); failErr != nil {
+			log.Println(failErr.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+func removeCluster(ctx context.Context, nc *nats.Conn, serverUrl string, record *clusterRecord) error {
+	clusterId := record.clusterId
+	agentCluster := record.AgentCluster
+
+	teardowner, err := cloud.New(ctx, agentCluster.Provider, cloud.Options{
+		ServerUrl: serverUrl,
+		Params:    agentCluster.ProviderParams,
+	})
 	if err != nil {
-		log.Println(err.Error())
-		return subcommands.ExitFailure
+		return err
 	}
 
 	// get instance ids
@@ -113,46 +139,83 @@ func (ec *teardownAgentsCmd) Execute(ctx context.Context, f *flag.FlagSet, args
 	for _, instance := range agentCluster.ComputeInstances {
 		instanceIds = append(instanceIds, instance.InstanceId)
 	}
-
-	// terminate compute instances
-	log.Printf("terminating compute instances: %v", instanceIds)
-	if err = teardowner.TerminateComputeInstances(teardownCtx, instanceIds); err != nil {
-		log.Println(err.Error())
-		return subcommands.ExitFailure
+	securityGroupIds := union([]string{agentCluster.SecurityGroupId}, nil)
+
+	// also tear down whatever belongs to the cluster but didn't make it into the record
+	if discoverer, ok := teardowner.(cloud.Discoverer); ok {
+		discoveredInstanceIds, discoveredSecurityGroupIds, err := discoverer.DiscoverResources(ctx, clusterId)
+		if err != nil {
+			return err
+		}
+		instanceIds = union(instanceIds, discoveredInstanceIds)
+		securityGroupIds = union(securityGroupIds, discoveredSecurityGroupIds)
 	}
-	log.Println("terminated compute instances")
 
-	// delete security group
-	log.Printf("deleting security group %s: %s", agentCluster.SecurityGroupName, agentCluster.SecurityGroupId)
-	if err = teardowner.DeleteSecurityGroup(teardownCtx, agentCluster.SecurityGroupId); err != nil {
-		log.Println(err.Error())
-		return subcommands.ExitFailure
+	// terminate compute instances
+	if len(instanceIds) > 0 {
+		log.Printf("terminating compute instances: %v", instanceIds)
+		if err = teardowner.TerminateComputeInstances(ctx, instanceIds); err != nil {
+			return err
+		}
+		log.Println("terminated compute instances")
 	}
-	log.Println("deleted security group")
 
-	// remove entry from bucket
-	if err = smithyClustersDataBucket.Delete(ctx, ec.clusterId); err != nil {
-		log.Println(err.Error())
-		return subcommands.ExitFailure
+	// delete security groups
+	for _, securityGroupId := range securityGroupIds {
+		log.Printf("deleting security group %s: %s", agentCluster.SecurityGroupName, securityGroupId)
+		if err = teardowner.DeleteSecurityGroup(ctx, securityGroupId); err != nil {
+			return err
+		}
+		log.Println("deleted security group")
 	}
 
 	jsObj, err := nc.JetStream()
 	if err != nil {
-		log.Println(err.Error())
-		return subcommands.ExitFailure
+		return err
 	}
 	// remove entry from smithy clusters object store
 	obj, err := jsObj.ObjectStore(meta.SmithyClustersObjStoreName)
 	if err != nil {
-		log.Println(err.Error())
-		return subcommands.ExitFailure
+		return err
 	}
 
-	configFileName := fmt.Sprintf("%s-server.conf", ec.clusterId)
-	if err = obj.Delete(configFileName); err != nil {
-		log.Println(err.Error())
-		return subcommands.ExitFailure
+	// clusters that failed to deploy may have no config, clusters deployed with a
+	// custom template have a config per node instead of a shared one
+	configNames := []string{agent.ConfigObjectName(clusterId)}
+	for _, instance := range agentCluster.ComputeInstances {
+		if instance.AgentId != "" {
+			configNames = append(configNames, agent.NodeConfigObjectName(clusterId, instance.AgentId))
+		}
+	}
+	for _, configName := range configNames {
+		if err = obj.Delete(configName); err != nil && err != nats.ErrObjectNotFound {
+			return err
+		}
 	}
 
-	return subcommands.ExitSuccess
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return err
+	}
+	heartbeatBucketName := agent.HeartbeatBucketName(clusterId)
+	if err = js.DeleteKeyValue(ctx, heartbeatBucketName); err != nil && err != jetstream.ErrBucketNotFound {
+		return err
+	}
+
+	// remove entry from bucket, last so a failed teardown can be retried
+	return record.delete(ctx)
+}
+
+// union returns the distinct values of both slices, keeping their order
+func union(a []string, b []string) []string {
+	seen := map[string]bool{}
+	values := []string{}
+	for _, value := range append(append([]string{}, a...), b...) {
+		if value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+		values = append(values, value)
+	}
+	return values
 }
@@ -0,0 +1,190 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"smithy/pkg/cloud"
+	"sync"
+)
+
+const FakeProviderName = "fake"
+
+func init() {
+	cloud.Register(FakeProviderName, func(ctx context.Context, opts cloud.Options) (cloud.Provider, error) {
+		return Fake, nil
+	})
+}
+
+// Fake is the provider instance handed out for the "fake" provider, it keeps its
+// resources in memory for the lifetime of the process
+var Fake = NewFakeProvider()
+
+// FakeProvider is an in-memory cloud provider, it creates no processes or machines
+type FakeProvider struct {
+	mu             sync.Mutex
+	nextId         int
+	securityGroups map[string]string
+	instances      map[string]cloud.ComputeInstance
+	// cluster id of every security group and instance
+	clusterIds map[string]string
+	// injected errors, returned once by the next call of the operation
+	errors map[string]error
+}
+
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{
+		securityGroups: map[string]string{},
+		instances:      map[string]cloud.ComputeInstance{},
+		clusterIds:     map[string]string{},
+		errors:         map[string]error{},
+	}
+}
+
+// Reset forgets every resource and injected error, e.g. those left behind by a
+// previous test
+func (fp *FakeProvider) Reset() {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.securityGroups = map[string]string{}
+	fp.instances = map[string]cloud.ComputeInstance{}
+	fp.clusterIds = map[string]string{}
+	fp.errors = map[string]error{}
+}
+
+// InjectError makes the next call to the named operation, e.g. "CreateComputeInstances", fail
+func (fp *FakeProvider) InjectError(operation string, err error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.errors[operation] = err
+}
+
+func (fp *FakeProvider) takeError(operation string) error {
+	err := fp.errors[operation]
+	delete(fp.errors, operation)
+	return err
+}
+
+// SecurityGroups returns the ids of the existing security groups by name
+func (fp *FakeProvider) SecurityGroups() map[string]string {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	securityGroups := map[string]string{}
+	for id, name := range fp.securityGroups {
+		securityGroups[name] = id
+	}
+	return securityGroups
+}
+
+// Instances returns the running compute instances by instance id
+func (fp *FakeProvider) Instances() map[string]cloud.ComputeInstance {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	instances := map[string]cloud.ComputeInstance{}
+	for id, instance := range fp.instances {
+		instances[id] = instance
+	}
+	return instances
+}
+
+func (fp *FakeProvider) CreateSecurityGroup(ctx context.Context, securityGroupName string, clusterId string) (string, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if err := fp.takeError("CreateSecurityGroup"); err != nil {
+		return "", err
+	}
+	for _, name := range fp.securityGroups {
+		if name == securityGroupName {
+			return "", fmt.Errorf("security group %s already exists", securityGroupName)
+		}
+	}
+	fp.nextId++
+	securityGroupId := fmt.Sprintf("fake-sg-%d", fp.nextId)
+	fp.securityGroups[securityGroupId] = securityGroupName
+	fp.clusterIds[securityGroupId] = clusterId
+	return securityGroupId, nil
+}
+
+func (fp *FakeProvider) DeleteSecurityGroup(ctx context.Context, securityGroupId string) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if err := fp.takeError("DeleteSecurityGroup"); err != nil {
+		return err
+	}
+	if _, ok := fp.securityGroups[securityGroupId]; !ok {
+		return fmt.Errorf("security group %s does not exist", securityGroupId)
+	}
+	delete(fp.securityGroups, securityGroupId)
+	delete(fp.clusterIds, securityGroupId)
+	return nil
+}
+
+func (fp *FakeProvider) CreateComputeInstances(ctx context.Context, securityGroupName string, instanceTagName string, instanceCount int32, credsPath string, clusterId string) ([]cloud.ComputeInstance, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if err := fp.takeError("CreateComputeInstances"); err != nil {
+		return nil, err
+	}
+	computeInstances := []cloud.ComputeInstance{}
+	for nodeIndex := 0; nodeIndex < int(instanceCount); nodeIndex++ {
+		fp.nextId++
+		computeInstance := cloud.ComputeInstance{
+			DnsName:    fmt.Sprintf("node-%d.fake.internal", fp.nextId),
+			InstanceId: fmt.Sprintf("fake-i-%d", fp.nextId),
+			PrivateIp:  fmt.Sprintf("10.0.0.%d", fp.nextId),
+			PublicIp:   fmt.Sprintf("192.0.2.%d", fp.nextId),
+			AgentId:    fmt.Sprintf("%s-node-%d", clusterId, nodeIndex),
+		}
+		fp.instances[computeInstance.InstanceId] = computeInstance
+		fp.clusterIds[computeInstance.InstanceId] = clusterId
+		computeInstances = append(computeInstances, computeInstance)
+	}
+	return computeInstances, nil
+}
+
+func (fp *FakeProvider) TerminateComputeInstances(ctx context.Context, instanceIds []string) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if err := fp.takeError("TerminateComputeInstances"); err != nil {
+		return err
+	}
+	for _, instanceId := range instanceIds {
+		if _, ok := fp.instances[instanceId]; !ok {
+			return fmt.Errorf("instance %s does not exist", instanceId)
+		}
+	}
+	for _, instanceId := range instanceIds {
+		delete(fp.instances, instanceId)
+		delete(fp.clusterIds, instanceId)
+	}
+	return nil
+}
+
+func (fp *FakeProvider) ListResources(ctx context.Context) ([]cloud.Resource, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if err := fp.takeError("ListResources"); err != nil {
+		return nil, err
+	}
+	resources := []cloud.Resource{}
+	for id, name := range fp.securityGroups {
+		resources = append(resources, cloud.Resource{
+			Kind:      cloud.ResourceSecurityGroup,
+			Id:        id,
+			Name:      name,
+			ClusterId: fp.clusterIds[id],
+		})
+	}
+	for id, instance := range fp.instances {
+		resources = append(resources, cloud.Resource{
+			Kind:      cloud.ResourceInstance,
+			Id:        id,
+			Name:      instance.AgentId,
+			ClusterId: fp.clusterIds[id],
+		})
+	}
+	return resources, nil
+}
+
+func (fp *FakeProvider) InScope(params map[string]string) bool {
+	return true
+}
@@ -0,0 +1,236 @@
+// Package harness runs smithy commands against an in-process JetStream server
+// and a fake cloud provider, so commands can be exercised without a real NATS
+// deployment or cloud account.
+package harness
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"smithy/cmd"
+	"smithy/internal/meta"
+	"smithy/pkg/cloud"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+type Harness struct {
+	server   *server.Server
+	storeDir string
+	nc       *nats.Conn
+	js       jetstream.JetStream
+	obj      nats.ObjectStore
+}
+
+// New starts a JetStream enabled server on a random port and provisions the
+// smithy buckets on it
+func New() (*Harness, error) {
+	storeDir, err := os.MkdirTemp("", "smithy-harness-")
+	if err != nil {
+		return nil, err
+	}
+
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  storeDir,
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		os.RemoveAll(storeDir)
+		return nil, fmt.Errorf("unable to create server, %v", err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(10 * time.Second) {
+		ns.Shutdown()
+		os.RemoveAll(storeDir)
+		return nil, fmt.Errorf("server not ready for connections")
+	}
+
+	h := &Harness{
+		server:   ns,
+		storeDir: storeDir,
+	}
+	if err = h.provision(); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// provision creates the bucket and object store every command expects
+func (h *Harness) provision() error {
+	if rc := h.Run("init"); rc != 0 {
+		return fmt.Errorf("init exited with %d", rc)
+	}
+
+	nc, err := nats.Connect(h.Url())
+	if err != nil {
+		return err
+	}
+	h.nc = nc
+
+	if h.js, err = jetstream.New(nc); err != nil {
+		return err
+	}
+	jsObj, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+	h.obj, err = jsObj.ObjectStore(meta.SmithyClustersObjStoreName)
+	return err
+}
+
+// Url is the client url of the embedded server
+func (h *Harness) Url() string {
+	return h.server.ClientURL()
+}
+
+// Conn is a connection to the embedded server, owned by the harness
+func (h *Harness) Conn() *nats.Conn {
+	return h.nc
+}
+
+// Run executes a smithy command line against the embedded server, the -server
+// flag is inserted after the subcommand name
+func (h *Harness) Run(args ...string) int {
+	if len(args) == 0 {
+		return cmd.Run(args)
+	}
+	withServer := append([]string{args[0], "-server", h.Url()}, args[1:]...)
+	return cmd.Run(withServer)
+}
+
+// RunOutput is Run, it also returns what the command printed to stdout
+func (h *Harness) RunOutput(args ...string) (int, string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, "", err
+	}
+	output := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		output <- buf.String()
+	}()
+
+	stdout := os.Stdout
+	os.Stdout = w
+	rc := h.Run(args...)
+	os.Stdout = stdout
+	w.Close()
+	return rc, <-output, nil
+}
+
+// Deploy runs deploy-agents with the fake provider
+func (h *Harness) Deploy(clusterId string, agents int, extraArgs ...string) int {
+	args := append([]string{"deploy-agents", "-provider", FakeProviderName, "-id", clusterId, "-n", fmt.Sprint(agents)}, extraArgs...)
+	return h.Run(args...)
+}
+
+// Bucket is the cluster bucket
+func (h *Harness) Bucket(ctx context.Context) (jetstream.KeyValue, error) {
+	return h.js.KeyValue(ctx, meta.SmithyClustersDataBucketName)
+}
+
+// ObjectStore is the smithy object store
+func (h *Harness) ObjectStore() nats.ObjectStore {
+	return h.obj
+}
+
+// AgentCluster loads a cluster record from the bucket
+func (h *Harness) AgentCluster(ctx context.Context, clusterId string) (*cloud.AgentCluster, error) {
+	kv, err := h.Bucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := kv.Get(ctx, clusterId)
+	if err != nil {
+		return nil, err
+	}
+	return cloud.LoadAgentCluster(entry.Value())
+}
+
+// ClusterIds lists the keys of the cluster bucket
+func (h *Harness) ClusterIds(ctx context.Context) ([]string, error) {
+	kv, err := h.Bucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := kv.Keys(ctx)
+	if err == jetstream.ErrNoKeysFound {
+		return []string{}, nil
+	}
+	return keys, err
+}
+
+// Object reads an object from the smithy object store
+func (h *Harness) Object(name string) ([]byte, error) {
+	return h.obj.GetBytes(name)
+}
+
+// Capture records the messages published on a subject
+type Capture struct {
+	sub  *nats.Subscription
+	mu   sync.Mutex
+	msgs []*nats.Msg
+}
+
+func (h *Harness) Capture(subject string) (*Capture, error) {
+	c := &Capture{}
+	sub, err := h.nc.Subscribe(subject, func(msg *nats.Msg) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.msgs = append(c.msgs, msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// make sure the interest is registered before any command publishes
+	if err = h.nc.Flush(); err != nil {
+		return nil, err
+	}
+	c.sub = sub
+	return c, nil
+}
+
+// Messages returns the messages captured so far
+func (c *Capture) Messages() []*nats.Msg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*nats.Msg{}, c.msgs...)
+}
+
+// Wait blocks until at least n messages were captured or the timeout expires
+func (c *Capture) Wait(n int, timeout time.Duration) []*nats.Msg {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if msgs := c.Messages(); len(msgs) >= n {
+			return msgs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return c.Messages()
+}
+
+func (c *Capture) Stop() {
+	c.sub.Unsubscribe()
+}
+
+// Close shuts the server down and removes its storage
+func (h *Harness) Close() {
+	if h.nc != nil {
+		h.nc.Close()
+	}
+	h.server.Shutdown()
+	h.server.WaitForShutdown()
+	os.RemoveAll(h.storeDir)
+}
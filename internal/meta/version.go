@@ -0,0 +1,31 @@
+package meta
+
+import (
+	"regexp"
+	"runtime/debug"
+	"strings"
+)
+
+// Version of smithy, set at build time with -ldflags "-X smithy/internal/meta.Version=<version>",
+// see .goreleaser.yaml. Builds without it use the module version when go knows it.
+var Version = "dev"
+
+func init() {
+	if Version != "dev" {
+		return
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		Version = info.Main.Version
+	}
+}
+
+var releaseVersion = regexp.MustCompile(`^v?[0-9]+\.[0-9]+\.[0-9]+$`)
+
+// ReleaseVersion is the release this smithy was built as, e.g. 0.0.8, ok is false
+// for development builds that no release can be downloaded for
+func ReleaseVersion() (version string, ok bool) {
+	if !releaseVersion.MatchString(Version) {
+		return "", false
+	}
+	return strings.TrimPrefix(Version, "v"), true
+}
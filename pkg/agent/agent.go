@@ -2,26 +2,71 @@ package agent
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
-	"os"
-	"os/exec"
 	"smithy/internal/meta"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 )
 
 type Agent struct {
 	clusterId string
 	agentId   string
+	opts      Options
 	nc        *nats.Conn
+
+	obj      nats.ObjectStore
+	handlers map[string]handler
+
+	mu     sync.Mutex
+	server *serverProcess
+	// restarts since nats-server last ran stable, restartTimer is a pending restart
+	restarts     int
+	restartTimer *time.Timer
+	gaveUp       bool
+
+	startedAt time.Time
+}
+
+// Options override the nats-server settings from the cluster config, they are
+// needed when several agents share a host
+type Options struct {
+	// ClientPort, ClusterPort and MonitorPort override the configured nats-server
+	// ports when non-zero
+	ClientPort  int
+	ClusterPort int
+	MonitorPort int
+	// WorkDir holds the server config, jetstream store and log, defaults to $HOME
+	WorkDir string
+	// MaxRestarts is how often nats-server is restarted after it exited on its
+	// own, zero disables restarts. The delay starts at RestartBackoff and
+	// doubles up to MaxRestartBackoff.
+	MaxRestarts       int
+	RestartBackoff    time.Duration
+	MaxRestartBackoff time.Duration
+	// StreamLogs publishes the lines of the agent's and nats-server's log files,
+	// AgentLogFile defaults to the file stdout is redirected to
+	StreamLogs   bool
+	AgentLogFile string
+	// ExecAllow are the programs the exec command may run, with any arguments,
+	// none disables it
+	ExecAllow []string
 }
 
 const (
 	SmithyAgentsStreamName = "smithy-agents"
+
+	DefaultMaxRestarts       = 5
+	DefaultRestartBackoff    = time.Second
+	DefaultMaxRestartBackoff = time.Minute
 )
 
-func New(serverUrl string, credsPath string, clusterId string, agentId string) (*Agent, error) {
+func New(serverUrl string, credsPath string, clusterId string, agentId string, agentOpts Options) (*Agent, error) {
 
 	opts := []nats.Option{}
 
@@ -38,6 +83,8 @@ func New(serverUrl string, credsPath string, clusterId string, agentId string) (
 		nc:        nc,
 		clusterId: clusterId,
 		agentId:   agentId,
+		opts:      agentOpts,
+		startedAt: time.Now(),
 	}, nil
 }
 
@@ -50,47 +97,140 @@ func (a *Agent) Start(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	obj, err := js.ObjectStore(meta.SmithyClustersObjStoreName)
+	a.obj, err = js.ObjectStore(meta.SmithyClustersObjStoreName)
 	if err != nil {
 		return err
 	}
 
-	configFileName := fmt.Sprintf("%s-server.conf", a.clusterId)
-	serverConfigFilePath := fmt.Sprintf("%s/%s", os.Getenv("HOME"), configFileName)
+	a.handlers = map[string]handler{
+		CommandStart:   a.handleStart,
+		CommandStop:    a.handleStop,
+		CommandRestart: a.handleRestart,
+		CommandReload:  a.handleReload,
+		CommandExec:    a.handleExec,
+		CommandCollect: a.handleCollect,
+	}
 
-	a.nc.Subscribe(fmt.Sprintf("%s.%s", SmithyAgentsStreamName, a.clusterId), func(msg *nats.Msg) {
-		fmt.Printf("Received message: %s\n", string(msg.Data))
+	sub, err := a.nc.Subscribe(CommandSubject(a.clusterId), a.handle)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
 
-		if string(msg.Data) == "start" {
+	// deploy-agents creates the heartbeat bucket, older releases didn't
+	kvJs, err := jetstream.New(a.nc)
+	if err != nil {
+		return err
+	}
+	heartbeats, err := HeartbeatBucket(ctx, kvJs, a.clusterId)
+	if err != nil {
+		return err
+	}
 
-			// create empty server.conf file in home directory
-			if err = os.WriteFile(serverConfigFilePath, []byte(""), 0644); err != nil {
-				panic(err)
-			}
-			// get server.conf file from object store
-			if err = obj.GetFile(configFileName, serverConfigFilePath); err != nil {
-				fmt.Printf("Error getting file: %s\n", err.Error())
-				return
-			}
+	if a.opts.StreamLogs {
+		a.streamLogs(ctx)
+	}
 
-			// run the command `nats-server` in a subprocess
-			args := []string{"-c", serverConfigFilePath, "-name", a.agentId}
-			cmd := exec.Command("nats-server", args...)
-			if err = cmd.Start(); err != nil {
-				fmt.Printf("Error running command: %s\n", err.Error())
-			} else {
-				fmt.Printf("nats-server running in process %d\n", cmd.Process.Pid)
-			}
+	// report until context is done
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		a.heartbeat(ctx, heartbeats)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// handler runs a command, the returned data is sent back in the reply
+type handler func(command *Command) (interface{}, error)
+
+func (a *Agent) handle(msg *nats.Msg) {
+	fmt.Printf("Received message: %s\n", string(msg.Data))
+
+	// older smithy releases send the bare command and expect no reply
+	if string(msg.Data) == CommandStart {
+		if _, err := a.handleStart(&Command{Command: CommandStart}); err != nil {
+			fmt.Println(err.Error())
 		}
+		return
+	}
 
-	})
+	command := &Command{}
+	if err := json.Unmarshal(msg.Data, command); err != nil {
+		a.reply(msg, &Reply{AgentId: a.agentId, Error: fmt.Sprintf("invalid command, %v", err)})
+		return
+	}
+	if !command.targets(a.agentId) {
+		return
+	}
 
-	// block until context is done
-	<-ctx.Done()
+	// the subscription delivers one message at a time, commands that wait for
+	// long don't hold up the others
+	if _, ok := asyncCommands[command.Command]; ok {
+		go a.run(msg, command)
+		return
+	}
+	a.run(msg, command)
+}
 
-	return nil
+// asyncCommands are handled concurrently with other commands
+var asyncCommands = map[string]struct{}{
+	CommandStop: {},
+	CommandExec: {},
+}
+
+// run handles a command and replies with its outcome
+func (a *Agent) run(msg *nats.Msg, command *Command) {
+	reply := &Reply{
+		RequestId: command.RequestId,
+		AgentId:   a.agentId,
+	}
+	if h, ok := a.handlers[command.Command]; !ok {
+		reply.Error = fmt.Sprintf("unknown command %s", command.Command)
+	} else if data, err := h(command); err != nil {
+		reply.Error = err.Error()
+	} else {
+		reply.Ok = true
+		if data != nil {
+			if reply.Data, err = json.Marshal(data); err != nil {
+				reply.Ok, reply.Error = false, fmt.Sprintf("unable to serialize reply, %v", err)
+			}
+		}
+	}
+	if !reply.Ok {
+		fmt.Printf("%s failed: %s\n", command.Command, reply.Error)
+	}
+	a.reply(msg, reply)
+}
+
+// reply responds to commands sent with a reply subject
+func (a *Agent) reply(msg *nats.Msg, reply *Reply) {
+	if msg.Reply == "" {
+		return
+	}
+	data, err := json.Marshal(reply)
+	if err != nil {
+		fmt.Printf("Error serializing reply: %s\n", err.Error())
+		return
+	}
+	if err = msg.Respond(data); err != nil {
+		fmt.Printf("Error replying: %s\n", err.Error())
+	}
 }
 
 func (a *Agent) Stop() {
-	a.nc.Close()
+	defer a.nc.Close()
+
+	// don't leave the nats-server behind when the agent goes away
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cancelRestart()
+	if a.server != nil {
+		if err := a.stopServer(syscall.SIGTERM, stopGracePeriod); err != nil {
+			log.Println(err.Error())
+		}
+	}
 }
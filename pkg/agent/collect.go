@@ -0,0 +1,140 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// CollectObjectPrefix is where agents upload collected diagnostics to
+	CollectObjectPrefix = "_collect"
+	// how many log lines are collected unless the command says otherwise
+	defaultCollectLogLines = 500
+	// how much of a log file is read to find its last lines
+	maxLogTailBytes = 4 * 1024 * 1024
+)
+
+// monitoring endpoints collected from nats-server
+var collectEndpoints = []string{"healthz", "varz", "connz", "routez", "jsz"}
+
+// CollectArgs are the args of the collect command, the files of a collect are
+// uploaded as <CollectObjectPrefix>/<request id>/<agent id>/<file>
+type CollectArgs struct {
+	LogLines int `json:"log_lines,omitempty"`
+}
+
+// CollectData is the data of successful collect replies, artifacts that couldn't
+// be collected are listed in Errors
+type CollectData struct {
+	Files  map[string]string `json:"files"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// CollectObjectName is the object an agent uploads a collected file to
+func CollectObjectName(requestId string, agentId string, file string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", CollectObjectPrefix, requestId, agentId, file)
+}
+
+// handleCollect gathers diagnostics and uploads them to the object store
+func (a *Agent) handleCollect(command *Command) (interface{}, error) {
+	args := &CollectArgs{}
+	if len(command.Args) > 0 {
+		if err := json.Unmarshal(command.Args, args); err != nil {
+			return nil, fmt.Errorf("invalid collect args, %v", err)
+		}
+	}
+	if args.LogLines <= 0 {
+		args.LogLines = defaultCollectLogLines
+	}
+
+	data := &CollectData{
+		Files:  map[string]string{},
+		Errors: map[string]string{},
+	}
+	collect := func(file string, content []byte, err error) {
+		if err != nil {
+			data.Errors[file] = err.Error()
+			return
+		}
+		objectName := CollectObjectName(command.RequestId, a.agentId, file)
+		if _, err = a.obj.PutBytes(objectName, content); err != nil {
+			data.Errors[file] = fmt.Sprintf("unable to upload, %v", err)
+			return
+		}
+		data.Files[file] = objectName
+	}
+
+	a.mu.Lock()
+	state, _ := a.serverState()
+	a.mu.Unlock()
+	port := a.monitorPort()
+	for _, endpoint := range collectEndpoints {
+		file := endpoint + ".json"
+		switch {
+		case state != ServerRunning:
+			collect(file, nil, fmt.Errorf("nats-server is %s", state))
+		case port == 0:
+			collect(file, nil, fmt.Errorf("nats-server monitoring is disabled"))
+		default:
+			ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+			content, err := getMonitoring(ctx, fmt.Sprintf("http://127.0.0.1:%d/%s", port, endpoint))
+			cancel()
+			collect(file, content, err)
+		}
+	}
+
+	_, serverConfigFilePath := a.configFile()
+	for _, path := range []string{serverConfigFilePath, filepath.Join(filepath.Dir(serverConfigFilePath), "node.conf")} {
+		content, err := os.ReadFile(path)
+		collect(filepath.Base(path), content, err)
+	}
+
+	for file, path := range map[string]string{
+		"nats-server.log": a.serverLogFile(),
+		"agent.log":       a.agentLogFile(),
+	} {
+		content, err := tailFile(path, args.LogLines)
+		collect(file, content, err)
+	}
+
+	if len(data.Errors) == 0 {
+		data.Errors = nil
+	}
+	return data, nil
+}
+
+// tailFile returns the last lines of a file
+func tailFile(path string, lines int) ([]byte, error) {
+	if path == "" {
+		return nil, fmt.Errorf("log file unknown")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > maxLogTailBytes {
+		if _, err = file.Seek(-maxLogTailBytes, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+
+	tail := newTailBuffer(lines)
+	if _, err = io.Copy(tail, file); err != nil {
+		return nil, err
+	}
+	content := tail.String()
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return []byte(content), nil
+}
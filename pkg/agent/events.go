@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// lifecycle events of the supervised nats-server
+const (
+	EventStarted   = "started"
+	EventStopped   = "stopped"
+	EventExited    = "exited"
+	EventRestarted = "restarted"
+	EventGaveUp    = "gave-up"
+)
+
+// Event is published whenever the nats-server of an agent changes state
+type Event struct {
+	Event   string    `json:"event"`
+	AgentId string    `json:"agent_id"`
+	Time    time.Time `json:"time"`
+	Pid     int       `json:"pid,omitempty"`
+	// ExitCode and StderrTail describe how the server exited
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	StderrTail string `json:"stderr_tail,omitempty"`
+	// Restarts is the number of restarts since the server last ran stable
+	Restarts int    `json:"restarts,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// EventSubject is where an agent publishes its events, subscribe to
+// smithy.events.<cluster>.* for the events of a whole cluster
+func EventSubject(clusterId string, agentId string) string {
+	return fmt.Sprintf("smithy.events.%s.%s", clusterId, agentId)
+}
+
+// publish sends an event, events are informational so failures are only logged
+func (a *Agent) publish(event *Event) {
+	event.AgentId = a.agentId
+	event.Time = time.Now().UTC()
+	data, err := json.Marshal(event)
+	if err != nil {
+		fmt.Printf("Error serializing event: %s\n", err.Error())
+		return
+	}
+	if err = a.nc.Publish(EventSubject(a.clusterId, a.agentId), data); err != nil {
+		fmt.Printf("Error publishing event: %s\n", err.Error())
+	}
+}
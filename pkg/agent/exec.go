@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// SuggestedExecAllow are read-only diagnostic programs worth allowing, exec
+	// is disabled unless programs are allowed. Only the program is checked, it
+	// may be run with any arguments.
+	SuggestedExecAllow = "df,free,uptime,ss,ps"
+	// how long an exec may take unless the command says otherwise, and at most
+	defaultExecTimeout = 30 * time.Second
+	maxExecTimeout     = 5 * time.Minute
+	// how much of stdout and stderr is sent back, replies have to fit a message
+	maxExecOutput = 64 * 1024
+)
+
+// ExecArgs are the args of the exec command, Argv is run without a shell
+type ExecArgs struct {
+	Argv    []string      `json:"argv"`
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// ExecData is the data of successful exec replies, commands that ran count as
+// successful whatever their exit code
+type ExecData struct {
+	ExitCode  int    `json:"exit_code"`
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// limitedBuffer keeps the first max bytes written to it
+type limitedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); len(p) > room {
+		b.Buffer.Write(p[:room])
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// handleExec runs an allow-listed command
+func (a *Agent) handleExec(command *Command) (interface{}, error) {
+	args := &ExecArgs{}
+	if err := json.Unmarshal(command.Args, args); err != nil {
+		return nil, fmt.Errorf("invalid exec args, %v", err)
+	}
+	if len(args.Argv) == 0 {
+		return nil, fmt.Errorf("no command to run")
+	}
+	if !a.execAllowed(args.Argv[0]) {
+		if len(a.opts.ExecAllow) == 0 {
+			return nil, fmt.Errorf("exec is disabled on this agent")
+		}
+		return nil, fmt.Errorf("%s is not allowed, allowed commands are %s", args.Argv[0], strings.Join(a.opts.ExecAllow, ","))
+	}
+
+	timeout := args.Timeout
+	if timeout <= 0 {
+		timeout = defaultExecTimeout
+	}
+	if timeout > maxExecTimeout {
+		timeout = maxExecTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stdout := &limitedBuffer{max: maxExecOutput}
+	stderr := &limitedBuffer{max: maxExecOutput}
+	cmd := exec.CommandContext(ctx, args.Argv[0], args.Argv[1:]...)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	err := cmd.Run()
+	exitErr := &exec.ExitError{}
+	switch {
+	case ctx.Err() != nil:
+		return nil, fmt.Errorf("%s did not finish within %s", args.Argv[0], timeout)
+	case err != nil && !errors.As(err, &exitErr):
+		return nil, fmt.Errorf("unable to run %s, %v", args.Argv[0], err)
+	}
+	return &ExecData{
+		ExitCode:  cmd.ProcessState.ExitCode(),
+		Stdout:    stdout.String(),
+		Stderr:    stderr.String(),
+		Truncated: stdout.truncated || stderr.truncated,
+	}, nil
+}
+
+// ParseExecAllow splits the comma separated programs of an -exec-allow flag
+func ParseExecAllow(execAllow string) []string {
+	programs := []string{}
+	for _, program := range strings.Split(execAllow, ",") {
+		if program = strings.TrimSpace(program); program != "" {
+			programs = append(programs, program)
+		}
+	}
+	return programs
+}
+
+// execAllowed reports whether a program is on the agent's allow-list, the
+// arguments it is run with aren't restricted
+func (a *Agent) execAllowed(program string) bool {
+	for _, allowed := range a.opts.ExecAllow {
+		if program == allowed {
+			return true
+		}
+	}
+	return false
+}
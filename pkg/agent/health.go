@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// how long a poll of the monitoring endpoint may take
+const healthCheckTimeout = 2 * time.Second
+
+// ServerHealth is what the nats-server monitoring endpoint reports
+type ServerHealth struct {
+	// Ready is set when /healthz is ok, Error tells why it isn't
+	Ready bool   `json:"ready"`
+	Error string `json:"error,omitempty"`
+	// ServerName is the name the server reports, peers know it by this name
+	ServerName string `json:"server_name,omitempty"`
+	// Routes is the number of servers this one has routes to, Peers are their names
+	Routes int      `json:"routes"`
+	Peers  []string `json:"peers,omitempty"`
+	// JetStream is set when JetStream is enabled, MetaLeader is empty until
+	// the meta group elected a leader
+	JetStream       bool   `json:"jetstream"`
+	MetaLeader      string `json:"meta_leader,omitempty"`
+	MetaClusterSize int    `json:"meta_cluster_size,omitempty"`
+}
+
+// the parts of the monitoring responses the agent reports
+type (
+	healthz struct {
+		Status string `json:"status"`
+		Error  string `json:"error,omitempty"`
+	}
+	varz struct {
+		ServerName string `json:"server_name"`
+		JetStream  struct {
+			Config *json.RawMessage `json:"config,omitempty"`
+			Meta   *struct {
+				Leader string `json:"leader,omitempty"`
+				Size   int    `json:"cluster_size"`
+			} `json:"meta,omitempty"`
+		} `json:"jetstream"`
+	}
+	routez struct {
+		Routes []struct {
+			RemoteId   string `json:"remote_id"`
+			RemoteName string `json:"remote_name"`
+		} `json:"routes"`
+	}
+)
+
+// monitorPort is the port nats-server serves monitoring on, 0 if it doesn't
+func (a *Agent) monitorPort() int {
+	if a.opts.MonitorPort != 0 {
+		return a.opts.MonitorPort
+	}
+	config, err := a.serverConfig()
+	if err != nil {
+		return 0
+	}
+	switch port := config["http_port"].(type) {
+	case int64:
+		return int(port)
+	}
+	// http may also be given as host:port
+	if hostPort, ok := config["http"].(string); ok {
+		if _, port, err := net.SplitHostPort(hostPort); err == nil {
+			p, _ := strconv.Atoi(port)
+			return p
+		}
+	}
+	return 0
+}
+
+// checkHealth polls the monitoring endpoint of nats-server
+func (a *Agent) checkHealth(ctx context.Context, port int) *ServerHealth {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	baseUrl := fmt.Sprintf("http://127.0.0.1:%d", port)
+
+	health := &ServerHealth{}
+	status := &healthz{}
+	if err := getJson(ctx, baseUrl+"/healthz", status); err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	health.Ready = status.Status == "ok"
+	health.Error = status.Error
+
+	v := &varz{}
+	if err := getJson(ctx, baseUrl+"/varz", v); err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	health.ServerName = v.ServerName
+	health.JetStream = v.JetStream.Config != nil
+	if v.JetStream.Meta != nil {
+		health.MetaLeader = v.JetStream.Meta.Leader
+		health.MetaClusterSize = v.JetStream.Meta.Size
+	}
+
+	r := &routez{}
+	if err := getJson(ctx, baseUrl+"/routez", r); err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	// with route pooling there are several routes to every peer
+	peers := map[string]string{}
+	for _, route := range r.Routes {
+		peers[route.RemoteId] = route.RemoteName
+	}
+	for _, name := range peers {
+		health.Peers = append(health.Peers, name)
+	}
+	sort.Strings(health.Peers)
+	health.Routes = len(peers)
+
+	return health
+}
+
+// getJson decodes the response of a monitoring endpoint, /healthz answers
+// with an error status and a json body when the server isn't ready
+func getJson(ctx context.Context, url string, v interface{}) error {
+	body, err := getMonitoring(ctx, url)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("unable to read %s, %v", url, err)
+	}
+	return nil
+}
+
+// getMonitoring returns the raw response of a monitoring endpoint
+func getMonitoring(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach monitoring endpoint, %v", err)
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"smithy/internal/meta"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// HeartbeatInterval is how often agents report, an agent that hasn't
+	// reported for HeartbeatStaleAfter is considered stale
+	HeartbeatInterval   = 10 * time.Second
+	HeartbeatStaleAfter = 3 * HeartbeatInterval
+	// HeartbeatTTL is how long heartbeats are kept, agents that haven't
+	// reported for longer look like they never did
+	HeartbeatTTL = time.Hour
+)
+
+// states of the supervised nats-server
+const (
+	ServerRunning    = "running"
+	ServerRestarting = "restarting"
+	ServerGaveUp     = "gave-up"
+	ServerStopped    = "stopped"
+)
+
+// Heartbeat is stored under the agent id in the cluster's heartbeat bucket
+type Heartbeat struct {
+	AgentId string        `json:"agent_id"`
+	Time    time.Time     `json:"time"`
+	Uptime  time.Duration `json:"uptime"`
+	Version string        `json:"version"`
+	// ServerState is one of the Server* states, ServerPid is set while it runs
+	ServerState string `json:"server_state"`
+	ServerPid   int    `json:"server_pid,omitempty"`
+	// Health is polled from the monitoring endpoint while the server runs
+	Health *ServerHealth `json:"health,omitempty"`
+}
+
+// HeartbeatBucketName is the name of the bucket holding the heartbeats of a cluster
+func HeartbeatBucketName(clusterId string) string {
+	return fmt.Sprintf("smithy-heartbeats-%s", clusterId)
+}
+
+// HeartbeatBucket binds to the heartbeat bucket of a cluster, creating it if needed
+func HeartbeatBucket(ctx context.Context, js jetstream.JetStream, clusterId string) (jetstream.KeyValue, error) {
+	bucketName := HeartbeatBucketName(clusterId)
+	kv, err := js.KeyValue(ctx, bucketName)
+	if err != jetstream.ErrBucketNotFound {
+		return kv, err
+	}
+	kv, err = js.CreateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      bucketName,
+		Description: fmt.Sprintf("heartbeats of the agents of smithy cluster %s", clusterId),
+		TTL:         HeartbeatTTL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create bucket %s, %v", bucketName, err)
+	}
+	return kv, nil
+}
+
+// LoadHeartbeat deserializes a heartbeat
+func LoadHeartbeat(data []byte) (*Heartbeat, error) {
+	heartbeat := &Heartbeat{}
+	if err := json.Unmarshal(data, heartbeat); err != nil {
+		return nil, err
+	}
+	return heartbeat, nil
+}
+
+// heartbeat reports the agent's state, failures are only logged so a later
+// heartbeat can make up for them
+func (a *Agent) heartbeat(ctx context.Context, kv jetstream.KeyValue) {
+	heartbeat := &Heartbeat{
+		AgentId: a.agentId,
+		Time:    time.Now().UTC(),
+		Uptime:  time.Since(a.startedAt).Round(time.Second),
+		Version: meta.Version,
+	}
+	a.mu.Lock()
+	heartbeat.ServerState, heartbeat.ServerPid = a.serverState()
+	a.mu.Unlock()
+	if heartbeat.ServerState == ServerRunning {
+		if port := a.monitorPort(); port != 0 {
+			heartbeat.Health = a.checkHealth(ctx, port)
+		}
+	}
+
+	data, err := json.Marshal(heartbeat)
+	if err != nil {
+		fmt.Printf("Error serializing heartbeat: %s\n", err.Error())
+		return
+	}
+	if _, err = kv.Put(ctx, a.agentId, data); err != nil && ctx.Err() == nil {
+		fmt.Printf("Error sending heartbeat: %s\n", err.Error())
+	}
+}
+
+// serverState tells what the supervised nats-server is up to, a.mu must be held
+func (a *Agent) serverState() (string, int) {
+	switch {
+	case a.server != nil:
+		return ServerRunning, a.server.cmd.Process.Pid
+	case a.restartTimer != nil:
+		return ServerRestarting, 0
+	case a.gaveUp:
+		return ServerGaveUp, 0
+	default:
+		return ServerStopped, 0
+	}
+}
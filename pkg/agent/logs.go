@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// LogStreamName is the optional stream keeping the logs of all clusters
+	LogStreamName = "smithy-logs"
+	LogSubjects   = "smithy.logs.>"
+
+	// sources of log lines
+	LogSourceAgent      = "agent"
+	LogSourceNatsServer = "nats-server"
+
+	// how often log files are checked for new lines
+	logPollInterval = 500 * time.Millisecond
+)
+
+// LogLine is published for every line written to a log file an agent follows
+type LogLine struct {
+	AgentId string    `json:"agent_id"`
+	Source  string    `json:"source"`
+	Time    time.Time `json:"time"`
+	Line    string    `json:"line"`
+}
+
+// LogSubject is where an agent publishes its log lines, subscribe to
+// smithy.logs.<cluster>.* for the logs of a whole cluster
+func LogSubject(clusterId string, agentId string) string {
+	return fmt.Sprintf("smithy.logs.%s.%s", clusterId, agentId)
+}
+
+// streamLogs follows the agent's and nats-server's log files until ctx is done
+func (a *Agent) streamLogs(ctx context.Context) {
+	go a.followLog(ctx, LogSourceAgent, a.agentLogFile)
+	go a.followLog(ctx, LogSourceNatsServer, a.serverLogFile)
+}
+
+// agentLogFile is where the agent's output goes, the file its stdout is
+// redirected to unless configured
+func (a *Agent) agentLogFile() string {
+	if a.opts.AgentLogFile != "" {
+		return a.opts.AgentLogFile
+	}
+	stdout, err := os.Readlink("/proc/self/fd/1")
+	if err != nil {
+		return ""
+	}
+	if info, err := os.Stat(stdout); err != nil || !info.Mode().IsRegular() {
+		return ""
+	}
+	return stdout
+}
+
+// serverLogFile is where nats-server logs to, empty if it logs to stderr
+func (a *Agent) serverLogFile() string {
+	if a.opts.WorkDir != "" {
+		return filepath.Join(a.opts.WorkDir, "nats-server.log")
+	}
+	config, err := a.serverConfig()
+	if err != nil {
+		return ""
+	}
+	logFile, _ := config["log_file"].(string)
+	return logFile
+}
+
+// followLog publishes the lines appended to a log file. Files that exist when
+// the agent starts are followed from their end, files created later from their
+// start. Truncated and replaced files are followed from their start as well.
+func (a *Agent) followLog(ctx context.Context, source string, path func() string) {
+	ticker := time.NewTicker(logPollInterval)
+	defer ticker.Stop()
+
+	var (
+		file    *os.File
+		reader  *bufio.Reader
+		partial string
+		fromEnd = true
+	)
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	for {
+		if file == nil {
+			if opened, err := os.Open(path()); err == nil {
+				file, reader = opened, bufio.NewReader(opened)
+				if fromEnd {
+					file.Seek(0, io.SeekEnd)
+				}
+			}
+		}
+		// once the agent is up later files are new
+		fromEnd = false
+
+		if file != nil {
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					// keep what's there of the last line until it is complete
+					partial += line
+					break
+				}
+				a.publishLogLine(source, partial+line[:len(line)-1])
+				partial = ""
+			}
+			if logRotated(file, path()) {
+				file.Close()
+				file, partial = nil, ""
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// logRotated reports whether a log file was truncated, removed or replaced
+func logRotated(file *os.File, path string) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return true
+	}
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil || info.Size() < offset {
+		return true
+	}
+	current, err := os.Stat(path)
+	return err != nil || !os.SameFile(info, current)
+}
+
+// publishLogLine sends a log line, lines that can't be sent are dropped
+func (a *Agent) publishLogLine(source string, line string) {
+	data, err := json.Marshal(&LogLine{
+		AgentId: a.agentId,
+		Source:  source,
+		Time:    time.Now().UTC(),
+		Line:    line,
+	})
+	if err != nil {
+		return
+	}
+	a.nc.Publish(LogSubject(a.clusterId, a.agentId), data)
+}
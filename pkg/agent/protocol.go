@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// commands understood by the agents
+const (
+	CommandStart   = "start"
+	CommandStop    = "stop"
+	CommandRestart = "restart"
+	CommandReload  = "reload"
+	CommandExec    = "exec"
+	CommandCollect = "collect"
+)
+
+// Command is the envelope of every request sent to the agents of a cluster
+type Command struct {
+	Command   string `json:"command"`
+	RequestId string `json:"request_id"`
+	// Targets are the agent ids the command is meant for, empty means all agents
+	Targets []string        `json:"targets,omitempty"`
+	Args    json.RawMessage `json:"args,omitempty"`
+}
+
+// Reply is sent by every agent that acted on a command
+type Reply struct {
+	RequestId string          `json:"request_id"`
+	AgentId   string          `json:"agent_id"`
+	Ok        bool            `json:"ok"`
+	Error     string          `json:"error,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// StartData is the data of successful start, restart and reload replies
+type StartData struct {
+	Pid int `json:"pid"`
+}
+
+// CommandSubject is where the agents of a cluster receive commands
+func CommandSubject(clusterId string) string {
+	return fmt.Sprintf("%s.%s", SmithyAgentsStreamName, clusterId)
+}
+
+// NewCommand creates a command with a fresh request id, args are serialized as json
+func NewCommand(command string, targets []string, args interface{}) (*Command, error) {
+	c := &Command{
+		Command:   command,
+		RequestId: nuid.Next(),
+		Targets:   targets,
+	}
+	if args != nil {
+		rawArgs, err := json.Marshal(args)
+		if err != nil {
+			return nil, fmt.Errorf("unable to serialize %s args, %v", command, err)
+		}
+		c.Args = rawArgs
+	}
+	return c, nil
+}
+
+// targets reports whether the command is meant for an agent
+func (c *Command) targets(agentId string) bool {
+	if len(c.Targets) == 0 {
+		return true
+	}
+	for _, target := range c.Targets {
+		if target == agentId {
+			return true
+		}
+	}
+	return false
+}
+
+// Send publishes a command to the agents of a cluster and gathers their replies
+// until every expected agent replied or ctx is done. Without expected agents it
+// gathers replies until ctx is done.
+func Send(ctx context.Context, nc *nats.Conn, clusterId string, command *Command, expected []string) ([]*Reply, error) {
+	data, err := json.Marshal(command)
+	if err != nil {
+		return nil, fmt.Errorf("unable to serialize %s command, %v", command.Command, err)
+	}
+
+	inbox := nats.NewInbox()
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	if err = nc.PublishMsg(&nats.Msg{
+		Subject: CommandSubject(clusterId),
+		Reply:   inbox,
+		Data:    data,
+	}); err != nil {
+		return nil, err
+	}
+
+	pending := map[string]bool{}
+	for _, agentId := range expected {
+		pending[agentId] = true
+	}
+
+	replies := []*Reply{}
+	for len(expected) == 0 || len(pending) > 0 {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			// out of time, the caller tells who didn't reply
+			break
+		}
+		reply := &Reply{}
+		if err = json.Unmarshal(msg.Data, reply); err != nil || reply.RequestId != command.RequestId {
+			continue
+		}
+		replies = append(replies, reply)
+		delete(pending, reply.AgentId)
+	}
+	return replies, nil
+}
@@ -0,0 +1,304 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/conf"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// how long nats-server gets to shut down before it is killed
+	stopGracePeriod = 30 * time.Second
+	// lame duck mode takes lame_duck_duration, 2m by default, before the server exits
+	lameDuckGracePeriod = 3 * time.Minute
+)
+
+// serverProcess is a running nats-server, exited is closed once it has been waited on
+type serverProcess struct {
+	cmd       *exec.Cmd
+	exited    chan struct{}
+	err       error
+	startedAt time.Time
+	stderr    *tailBuffer
+	// stopping is set, with a.mu held, when the server is stopped on purpose
+	stopping bool
+}
+
+// StopArgs are the args of the stop command
+type StopArgs struct {
+	// LameDuck lets clients move to other servers before the server exits
+	LameDuck bool `json:"lame_duck,omitempty"`
+}
+
+// ConfigObjectName is the object holding the server config shared by the nodes of a cluster
+func ConfigObjectName(clusterId string) string {
+	return fmt.Sprintf("%s-server.conf", clusterId)
+}
+
+// NodeConfigObjectName is the object holding the server config of a single node,
+// agents prefer it over the shared one
+func NodeConfigObjectName(clusterId string, agentId string) string {
+	return fmt.Sprintf("%s/%s", ConfigObjectName(clusterId), agentId)
+}
+
+// configFile is the name of the cluster's server config and where it is stored locally
+func (a *Agent) configFile() (string, string) {
+	configFileName := ConfigObjectName(a.clusterId)
+	workDir := a.opts.WorkDir
+	if workDir == "" {
+		workDir = os.Getenv("HOME")
+	}
+	return configFileName, filepath.Join(workDir, configFileName)
+}
+
+// fetchConfig downloads the cluster's server config from the object store
+func (a *Agent) fetchConfig() (string, error) {
+	configFileName, serverConfigFilePath := a.configFile()
+
+	// download next to server.conf and only replace it once the download is
+	// complete, a failed fetch leaves the config the server runs with intact
+	tmpFile, err := os.CreateTemp(filepath.Dir(serverConfigFilePath), filepath.Base(serverConfigFilePath)+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("unable to create server config, %v", err)
+	}
+	tmpFilePath := tmpFile.Name()
+	tmpFile.Close()
+	defer os.Remove(tmpFilePath)
+	if err = os.Chmod(tmpFilePath, 0644); err != nil {
+		return "", fmt.Errorf("unable to create server config, %v", err)
+	}
+
+	// get server.conf file from object store, the node's own if there is one
+	err = a.obj.GetFile(NodeConfigObjectName(a.clusterId, a.agentId), tmpFilePath)
+	if err == nats.ErrObjectNotFound {
+		err = a.obj.GetFile(configFileName, tmpFilePath)
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to get server config, %v", err)
+	}
+	if err = os.Rename(tmpFilePath, serverConfigFilePath); err != nil {
+		return "", fmt.Errorf("unable to replace server config, %v", err)
+	}
+	return serverConfigFilePath, nil
+}
+
+// serverConfig parses the cluster's server config as it was last fetched
+func (a *Agent) serverConfig() (map[string]interface{}, error) {
+	_, serverConfigFilePath := a.configFile()
+	return conf.ParseFile(serverConfigFilePath)
+}
+
+// runServer starts nats-server with a config that is already in place, a.mu must be held
+func (a *Agent) runServer(serverConfigFilePath string) (*StartData, error) {
+	if a.server != nil {
+		return nil, fmt.Errorf("nats-server is already running in process %d", a.server.cmd.Process.Pid)
+	}
+
+	// run the command `nats-server` in a subprocess
+	args, err := a.serverArgs(serverConfigFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare server config, %v", err)
+	}
+	process := &serverProcess{
+		cmd:    exec.Command("nats-server", args...),
+		exited: make(chan struct{}),
+		stderr: newTailBuffer(stderrTailLines),
+	}
+	cmd := process.cmd
+	cmd.Stderr = process.stderr
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to run nats-server, %v", err)
+	}
+	process.startedAt = time.Now()
+	fmt.Printf("nats-server running in process %d\n", cmd.Process.Pid)
+
+	go func() {
+		process.err = cmd.Wait()
+		close(process.exited)
+		a.supervise(process)
+	}()
+	a.server = process
+
+	return &StartData{Pid: cmd.Process.Pid}, nil
+}
+
+// stopServer signals nats-server and waits for it to exit, killing it after
+// gracePeriod, a.mu must be held
+func (a *Agent) stopServer(signal syscall.Signal, gracePeriod time.Duration) error {
+	process, err := a.signalServer(signal)
+	if err != nil {
+		return err
+	}
+	process.awaitExit(gracePeriod)
+	a.server = nil
+	fmt.Printf("nats-server process %d stopped\n", process.cmd.Process.Pid)
+	return nil
+}
+
+// signalServer marks nats-server as stopped on purpose and signals it, a.mu must be held
+func (a *Agent) signalServer(signal syscall.Signal) (*serverProcess, error) {
+	process := a.server
+	if process == nil {
+		return nil, fmt.Errorf("nats-server is not running")
+	}
+	process.stopping = true
+
+	select {
+	case <-process.exited:
+		// already gone, nothing to signal
+	default:
+		if err := process.cmd.Process.Signal(signal); err != nil {
+			return nil, fmt.Errorf("unable to stop nats-server process %d, %v", process.cmd.Process.Pid, err)
+		}
+	}
+	return process, nil
+}
+
+// awaitExit waits for a signalled nats-server to exit, killing it after gracePeriod
+func (process *serverProcess) awaitExit(gracePeriod time.Duration) {
+	select {
+	case <-process.exited:
+	case <-time.After(gracePeriod):
+		fmt.Printf("nats-server process %d did not stop, killing it\n", process.cmd.Process.Pid)
+		process.cmd.Process.Kill()
+		<-process.exited
+	}
+}
+
+func (a *Agent) handleStart(command *Command) (interface{}, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.server != nil {
+		return nil, fmt.Errorf("nats-server is already running in process %d", a.server.cmd.Process.Pid)
+	}
+	serverConfigFilePath, err := a.fetchConfig()
+	if err != nil {
+		return nil, err
+	}
+	return a.startServer(serverConfigFilePath)
+}
+
+// startServer runs nats-server on behalf of a command, it starts over with the
+// restart policy, a.mu must be held
+func (a *Agent) startServer(serverConfigFilePath string) (*StartData, error) {
+	a.cancelRestart()
+	data, err := a.runServer(serverConfigFilePath)
+	if err != nil {
+		return nil, err
+	}
+	a.restarts, a.gaveUp = 0, false
+	a.publish(&Event{Event: EventStarted, Pid: data.Pid})
+	return data, nil
+}
+
+func (a *Agent) handleStop(command *Command) (interface{}, error) {
+	args := &StopArgs{}
+	if len(command.Args) > 0 {
+		if err := json.Unmarshal(command.Args, args); err != nil {
+			return nil, fmt.Errorf("invalid stop args, %v", err)
+		}
+	}
+
+	signal, gracePeriod := syscall.SIGTERM, stopGracePeriod
+	if args.LameDuck {
+		signal, gracePeriod = syscall.SIGUSR2, lameDuckGracePeriod
+	}
+
+	a.mu.Lock()
+	// waiting to be restarted after it exited, not restarting it is stopping it
+	if a.cancelRestart() && a.server == nil {
+		a.mu.Unlock()
+		return nil, nil
+	}
+	process, err := a.signalServer(signal)
+	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// lame duck mode takes minutes, don't keep the other commands and the
+	// heartbeats waiting for it
+	process.awaitExit(gracePeriod)
+	a.mu.Lock()
+	// a restart may have replaced it in the meantime
+	if a.server == process {
+		a.server = nil
+	}
+	a.mu.Unlock()
+	fmt.Printf("nats-server process %d stopped\n", process.cmd.Process.Pid)
+	return nil, nil
+}
+
+// handleRestart restarts nats-server with the config it was started with
+func (a *Agent) handleRestart(command *Command) (interface{}, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.server != nil {
+		if err := a.stopServer(syscall.SIGTERM, stopGracePeriod); err != nil {
+			return nil, err
+		}
+	}
+
+	// never started, there is no current config yet
+	_, serverConfigFilePath := a.configFile()
+	if _, err := os.Stat(serverConfigFilePath); err != nil {
+		if serverConfigFilePath, err = a.fetchConfig(); err != nil {
+			return nil, err
+		}
+	}
+	return a.startServer(serverConfigFilePath)
+}
+
+// handleReload fetches the cluster's current server config and has nats-server reload it
+func (a *Agent) handleReload(command *Command) (interface{}, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.server == nil {
+		return nil, fmt.Errorf("nats-server is not running")
+	}
+	if _, err := a.fetchConfig(); err != nil {
+		return nil, err
+	}
+	if err := a.server.cmd.Process.Signal(syscall.SIGHUP); err != nil {
+		return nil, fmt.Errorf("unable to reload nats-server process %d, %v", a.server.cmd.Process.Pid, err)
+	}
+	return &StartData{Pid: a.server.cmd.Process.Pid}, nil
+}
+
+// serverArgs builds the nats-server command line, applying the agent's overrides
+func (a *Agent) serverArgs(serverConfigFilePath string) ([]string, error) {
+	// wrap the cluster config in a per-node config, nats-server drops a server name
+	// given on the command line when it reloads its config and the store dir can't
+	// be overridden there when the config sets it
+	nodeConfig := fmt.Sprintf("include %q\n\nserver_name: %q\n", filepath.Base(serverConfigFilePath), a.agentId)
+	if a.opts.WorkDir != "" {
+		nodeConfig += fmt.Sprintf("\njetstream {\n  store_dir: %q\n}\n", filepath.Join(a.opts.WorkDir, "jetstream"))
+	}
+	configFilePath := filepath.Join(filepath.Dir(serverConfigFilePath), "node.conf")
+	if err := os.WriteFile(configFilePath, []byte(nodeConfig), 0644); err != nil {
+		return nil, err
+	}
+
+	args := []string{"-c", configFilePath}
+	if a.opts.ClientPort != 0 {
+		args = append(args, "-p", strconv.Itoa(a.opts.ClientPort))
+	}
+	if a.opts.ClusterPort != 0 {
+		args = append(args, "-cluster", fmt.Sprintf("nats://0.0.0.0:%d", a.opts.ClusterPort))
+	}
+	if a.opts.MonitorPort != 0 {
+		args = append(args, "-m", strconv.Itoa(a.opts.MonitorPort))
+	}
+	if a.opts.WorkDir != "" {
+		args = append(args, "-l", filepath.Join(a.opts.WorkDir, "nats-server.log"))
+	}
+	return args, nil
+}
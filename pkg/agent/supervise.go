@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// restarts are counted until nats-server stays up this long
+	stableRunPeriod = 5 * time.Minute
+	// how many stderr lines are kept to tell why nats-server exited
+	stderrTailLines = 20
+)
+
+// supervise runs once nats-server exited, it restarts the server unless it was
+// stopped on purpose
+func (a *Agent) supervise(process *serverProcess) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	event := &Event{
+		Pid:        process.cmd.Process.Pid,
+		StderrTail: process.stderr.String(),
+	}
+	if process.cmd.ProcessState != nil {
+		exitCode := process.cmd.ProcessState.ExitCode()
+		event.ExitCode = &exitCode
+	}
+	if process.stopping {
+		event.Event = EventStopped
+		a.publish(event)
+		return
+	}
+
+	if a.server == process {
+		a.server = nil
+	}
+	if time.Since(process.startedAt) >= stableRunPeriod {
+		a.restarts = 0
+	}
+	fmt.Printf("nats-server process %d exited unexpectedly: %v\n", event.Pid, process.err)
+	event.Event = EventExited
+	event.Restarts = a.restarts
+	if process.err != nil {
+		event.Error = process.err.Error()
+	}
+	a.publish(event)
+
+	a.scheduleRestart()
+}
+
+// scheduleRestart restarts nats-server after a backoff, unless it was restarted
+// too often already, a.mu must be held
+func (a *Agent) scheduleRestart() {
+	if a.restarts >= a.opts.MaxRestarts {
+		fmt.Printf("nats-server restarted %d times, giving up\n", a.restarts)
+		a.gaveUp = true
+		a.publish(&Event{Event: EventGaveUp, Restarts: a.restarts})
+		return
+	}
+
+	delay := a.restartBackoff()
+	a.restarts++
+	fmt.Printf("restarting nats-server in %s\n", delay)
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		// canceled by a command in the meantime
+		if a.restartTimer != timer {
+			return
+		}
+		a.restartTimer = nil
+		a.restartServer()
+	})
+	a.restartTimer = timer
+}
+
+// restartServer runs nats-server again with the config it was started with, a.mu must be held
+func (a *Agent) restartServer() {
+	_, serverConfigFilePath := a.configFile()
+	data, err := a.runServer(serverConfigFilePath)
+	if err != nil {
+		fmt.Println(err.Error())
+		a.publish(&Event{Event: EventExited, Restarts: a.restarts, Error: err.Error()})
+		a.scheduleRestart()
+		return
+	}
+	a.publish(&Event{Event: EventRestarted, Pid: data.Pid, Restarts: a.restarts})
+}
+
+// cancelRestart drops a pending restart, it reports whether there was one, a.mu must be held
+func (a *Agent) cancelRestart() bool {
+	if a.restartTimer == nil {
+		return false
+	}
+	a.restartTimer.Stop()
+	a.restartTimer = nil
+	return true
+}
+
+// restartBackoff doubles the delay with every restart, up to the configured maximum
+func (a *Agent) restartBackoff() time.Duration {
+	delay := a.opts.RestartBackoff
+	if delay <= 0 {
+		delay = DefaultRestartBackoff
+	}
+	maxDelay := a.opts.MaxRestartBackoff
+	if maxDelay <= 0 {
+		maxDelay = DefaultMaxRestartBackoff
+	}
+	for i := 0; i < a.restarts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
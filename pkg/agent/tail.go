@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"strings"
+	"sync"
+)
+
+// tailBuffer keeps the last lines written to it
+type tailBuffer struct {
+	mu    sync.Mutex
+	lines []string
+	max   int
+	// partial holds the last line until it is terminated
+	partial string
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := strings.Split(t.partial+string(p), "\n")
+	t.partial = lines[len(lines)-1]
+	t.lines = append(t.lines, lines[:len(lines)-1]...)
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+	return len(p), nil
+}
+
+// String returns the kept lines, including an unterminated last line
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := t.lines
+	if t.partial != "" {
+		lines = append(append([]string{}, lines...), t.partial)
+	}
+	return strings.Join(lines, "\n")
+}
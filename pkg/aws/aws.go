@@ -3,28 +3,187 @@ package aws
 import (
 	"context"
 	"fmt"
+	"smithy/internal/meta"
+	"smithy/pkg/cloud"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
 )
 
+const ProviderName = "aws"
+
+const (
+	DefaultRegion       = "us-east-2"
+	DefaultInstanceType = string(types.InstanceTypeT2Micro)
+	// TODO: put in a better key or use ec2instanceconnect
+	DefaultKeyName = "reuben-dev"
+	// latest Ubuntu 22.04 image, used to find an image outside the default region
+	DefaultImageSsmParameter = "/aws/service/canonical/ubuntu/server/22.04/stable/current/amd64/hvm/ebs-gp2/ami-id"
+
+	// Ubuntu 22.04 image in the default region
+	defaultImageAmiId = "ami-0e83be366243f524a"
+)
+
+// provider params, see Options
+const (
+	ParamRegion            = "region"
+	ParamImageId           = "ami"
+	ParamImageSsmParameter = "ami-ssm-parameter"
+	ParamInstanceType      = "instance-type"
+	ParamKeyName           = "key-name"
+	ParamSmithyVersion     = "smithy-version"
+)
+
+func init() {
+	cloud.Register(ProviderName, func(ctx context.Context, opts cloud.Options) (cloud.Provider, error) {
+		awsOpts := OptionsFromParams(opts.Params)
+		awsOpts.ExecAllow = opts.ExecAllow
+		return New(ctx, awsOpts)
+	})
+}
+
+// Options configure where and how instances are launched
+type Options struct {
+	Region string
+	// ImageId is the AMI to launch, when empty it is resolved from ImageSsmParameter
+	ImageId           string
+	ImageSsmParameter string
+	InstanceType      string
+	KeyName           string
+	// SmithyVersion is the smithy release the nodes install, defaults to the
+	// release of this smithy so agents understand its commands
+	SmithyVersion string
+	// ExecAllow are the programs the agents' exec command may run, none disables it
+	ExecAllow []string
+	// WaiterDelay overrides the delay between waiter polls when non-zero
+	WaiterDelay time.Duration
+}
+
+// OptionsFromParams reads options from provider params, missing params are left empty
+func OptionsFromParams(params map[string]string) Options {
+	return Options{
+		Region:            params[ParamRegion],
+		ImageId:           params[ParamImageId],
+		ImageSsmParameter: params[ParamImageSsmParameter],
+		InstanceType:      params[ParamInstanceType],
+		KeyName:           params[ParamKeyName],
+		SmithyVersion:     params[ParamSmithyVersion],
+	}
+}
+
+// withDefaults fills in the defaults for every unset option but the image id
+func (o Options) withDefaults() Options {
+	if o.Region == "" {
+		o.Region = DefaultRegion
+	}
+	if o.InstanceType == "" {
+		o.InstanceType = DefaultInstanceType
+	}
+	if o.KeyName == "" {
+		o.KeyName = DefaultKeyName
+	}
+	if o.ImageId == "" && o.ImageSsmParameter == "" && o.Region != DefaultRegion {
+		o.ImageSsmParameter = DefaultImageSsmParameter
+	}
+	if o.SmithyVersion == "" {
+		// stays empty for development builds
+		o.SmithyVersion, _ = meta.ReleaseVersion()
+	}
+	o.SmithyVersion = strings.TrimPrefix(o.SmithyVersion, "v")
+	return o
+}
+
+// EC2API is the subset of the EC2 client used by smithy
+type EC2API interface {
+	RunInstances(ctx context.Context, params *ec2.RunInstancesInput, optFns ...func(*ec2.Options)) (*ec2.RunInstancesOutput, error)
+	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+	TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error)
+	CreateSecurityGroup(ctx context.Context, params *ec2.CreateSecurityGroupInput, optFns ...func(*ec2.Options)) (*ec2.CreateSecurityGroupOutput, error)
+	// used by the security group waiter
+	DescribeSecurityGroups(ctx context.Context, params *ec2.DescribeSecurityGroupsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupsOutput, error)
+	AuthorizeSecurityGroupIngress(ctx context.Context, params *ec2.AuthorizeSecurityGroupIngressInput, optFns ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupIngressOutput, error)
+	DeleteSecurityGroup(ctx context.Context, params *ec2.DeleteSecurityGroupInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSecurityGroupOutput, error)
+	CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error)
+}
+
+// errSmithyVersion is returned when development builds deploy without being told
+// which release the nodes install
+var errSmithyVersion = fmt.Errorf("smithy %s is not a release the nodes can install, pass the release to install with -%s", meta.Version, ParamSmithyVersion)
+
 type AwsService struct {
-	svc *ec2.Client
+	svc  EC2API
+	opts Options
 }
 
-func New(ctx context.Context) (*AwsService, error) {
+func New(ctx context.Context, opts Options) (*AwsService, error) {
 
-	region := config.WithRegion("us-east-2")
+	opts = opts.withDefaults()
+	region := config.WithRegion(opts.Region)
 
 	cfg, err := config.LoadDefaultConfig(ctx, region)
 	if err != nil {
 		return nil, fmt.Errorf("unable to load SDK config, %v", err)
 	}
 
+	// resolve the image once, so the cluster keeps using it
+	if opts.ImageId == "" && opts.ImageSsmParameter != "" {
+		parameter, err := ssm.NewFromConfig(cfg).GetParameter(ctx, &ssm.GetParameterInput{
+			Name: aws.String(opts.ImageSsmParameter),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve image from ssm parameter %s, %v", opts.ImageSsmParameter, err)
+		}
+		opts.ImageId = aws.ToString(parameter.Parameter.Value)
+	}
+
 	// ec2 service
 	svc := ec2.NewFromConfig(cfg)
-	
+
+	return NewFromAPI(svc, opts), nil
+}
+
+// NewFromAPI creates a service on top of any EC2API implementation, images are
+// not resolved from ssm
+func NewFromAPI(svc EC2API, opts Options) *AwsService {
+	opts = opts.withDefaults()
+	if opts.ImageId == "" && opts.Region == DefaultRegion {
+		opts.ImageId = defaultImageAmiId
+	}
 	return &AwsService{
-		svc: svc,
-	}, nil
+		svc:  svc,
+		opts: opts,
+	}
+}
+
+// Params returns the effective options, they are persisted with the cluster so it
+// is always torn down in the region it was deployed to
+func (awsClient *AwsService) Params() map[string]string {
+	params := map[string]string{
+		ParamRegion:       awsClient.opts.Region,
+		ParamInstanceType: awsClient.opts.InstanceType,
+		ParamKeyName:      awsClient.opts.KeyName,
+	}
+	if awsClient.opts.SmithyVersion != "" {
+		params[ParamSmithyVersion] = awsClient.opts.SmithyVersion
+	}
+	if awsClient.opts.ImageId != "" {
+		params[ParamImageId] = awsClient.opts.ImageId
+	}
+	if awsClient.opts.ImageSsmParameter != "" {
+		params[ParamImageSsmParameter] = awsClient.opts.ImageSsmParameter
+	}
+	return params
+}
+
+// ValidateDeploy fails when the nodes wouldn't know which smithy release to install
+func (awsClient *AwsService) ValidateDeploy() error {
+	if awsClient.opts.SmithyVersion == "" {
+		return errSmithyVersion
+	}
+	return nil
 }
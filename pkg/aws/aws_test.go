@@ -0,0 +1,375 @@
+package aws_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	smithyaws "smithy/pkg/aws"
+	"smithy/pkg/aws/fakeec2"
+	"smithy/pkg/cloud"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func newService(t *testing.T) (*smithyaws.AwsService, *fakeec2.EC2) {
+	t.Helper()
+	fake := fakeec2.New()
+	svc := smithyaws.NewFromAPI(fake, smithyaws.Options{WaiterDelay: 10 * time.Millisecond, SmithyVersion: "0.0.8"})
+	return svc, fake
+}
+
+func credsFile(t *testing.T) string {
+	t.Helper()
+	credsPath := filepath.Join(t.TempDir(), "test.creds")
+	if err := os.WriteFile(credsPath, []byte("creds"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return credsPath
+}
+
+func tagValue(tags []types.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == key {
+			return aws.ToString(tag.Value)
+		}
+	}
+	return ""
+}
+
+func instanceStates(fake *fakeec2.EC2) map[string]types.InstanceStateName {
+	states := map[string]types.InstanceStateName{}
+	for _, instance := range fake.Instances() {
+		states[aws.ToString(instance.InstanceId)] = instance.State.Name
+	}
+	return states
+}
+
+// deploy creates the security group and the instances of a cluster
+func deploy(t *testing.T, ctx context.Context, svc *smithyaws.AwsService, clusterId string, n int32) (string, []cloud.ComputeInstance) {
+	t.Helper()
+	securityGroupName := "smithy-sg-" + clusterId
+	securityGroupId, err := svc.CreateSecurityGroup(ctx, securityGroupName, clusterId)
+	if err != nil {
+		t.Fatalf("CreateSecurityGroup: %v", err)
+	}
+	instances, err := svc.CreateComputeInstances(ctx, securityGroupName, "smithy-compute-node-"+clusterId, n, credsFile(t), clusterId)
+	if err != nil {
+		t.Fatalf("CreateComputeInstances: %v", err)
+	}
+	return securityGroupId, instances
+}
+
+func TestCreateSecurityGroup(t *testing.T) {
+	ctx := context.Background()
+	svc, fake := newService(t)
+
+	securityGroupId, err := svc.CreateSecurityGroup(ctx, "smithy-sg-a", "a")
+	if err != nil {
+		t.Fatalf("CreateSecurityGroup: %v", err)
+	}
+
+	groups := fake.SecurityGroups()
+	if len(groups) != 1 {
+		t.Fatalf("expected 1 security group, got %d", len(groups))
+	}
+	group := groups[0]
+	if aws.ToString(group.GroupId) != securityGroupId || aws.ToString(group.GroupName) != "smithy-sg-a" {
+		t.Errorf("unexpected security group %s %s", aws.ToString(group.GroupId), aws.ToString(group.GroupName))
+	}
+	if clusterId := tagValue(group.Tags, smithyaws.TagClusterId); clusterId != "a" {
+		t.Errorf("expected cluster id tag a, got %q", clusterId)
+	}
+
+	ports := []int{}
+	for _, permission := range group.IpPermissions {
+		ports = append(ports, int(aws.ToInt32(permission.FromPort)))
+	}
+	sort.Ints(ports)
+	if len(ports) != 3 || ports[0] != 22 || ports[1] != 4222 || ports[2] != 6222 {
+		t.Errorf("expected ingress on ports 22, 4222 and 6222, got %v", ports)
+	}
+
+	if _, err = svc.CreateSecurityGroup(ctx, "smithy-sg-a", "a"); err == nil {
+		t.Errorf("expected creating a duplicate security group to fail")
+	}
+}
+
+func TestCreateComputeInstances(t *testing.T) {
+	ctx := context.Background()
+	svc, fake := newService(t)
+	fake.TransitionPolls = 3
+
+	_, instances := deploy(t, ctx, svc, "a", 3)
+
+	if calls := fake.Calls("RunInstances"); calls != 1 {
+		t.Errorf("expected one batched RunInstances call, got %d", calls)
+	}
+	if len(instances) != 3 {
+		t.Fatalf("expected 3 compute instances, got %d", len(instances))
+	}
+	// the waiter only returns once the fake moved every instance out of pending
+	if calls := fake.Calls("DescribeInstances"); calls < fake.TransitionPolls+1 {
+		t.Errorf("expected the waiter to poll at least %d times, got %d", fake.TransitionPolls+1, calls)
+	}
+	for _, state := range instanceStates(fake) {
+		if state != types.InstanceStateNameRunning {
+			t.Errorf("expected instances to be running, got %s", state)
+		}
+	}
+
+	agentIds := map[string]bool{}
+	for _, ci := range instances {
+		agentIds[ci.AgentId] = true
+		if ci.InstanceId == "" || ci.DnsName == "" || ci.PrivateIp == "" || ci.PublicIp == "" {
+			t.Errorf("incomplete compute instance %+v", ci)
+		}
+	}
+	for _, agentId := range []string{"a-node-0", "a-node-1", "a-node-2"} {
+		if !agentIds[agentId] {
+			t.Errorf("expected agent %s, got %v", agentId, agentIds)
+		}
+	}
+
+	for _, instance := range fake.Instances() {
+		if clusterId := tagValue(instance.Tags, smithyaws.TagClusterId); clusterId != "a" {
+			t.Errorf("expected cluster id tag a, got %q", clusterId)
+		}
+		if nodeIndex := tagValue(instance.Tags, smithyaws.TagNodeIndex); nodeIndex == "" {
+			t.Errorf("instance %s has no node index tag", aws.ToString(instance.InstanceId))
+		}
+	}
+	for volumeId, tags := range fake.VolumeTags() {
+		if tagValue(tags, smithyaws.TagClusterId) != "a" || tagValue(tags, smithyaws.TagNodeIndex) == "" {
+			t.Errorf("volume %s is missing cluster tags %v", volumeId, tags)
+		}
+	}
+}
+
+func TestCreateComputeInstancesExecAllow(t *testing.T) {
+	ctx := context.Background()
+	for _, execAllow := range [][]string{nil, {"df", "ss"}} {
+		fake := fakeec2.New()
+		svc := smithyaws.NewFromAPI(fake, smithyaws.Options{WaiterDelay: 10 * time.Millisecond, SmithyVersion: "0.0.8", ExecAllow: execAllow})
+		_, instances := deploy(t, ctx, svc, "a", 1)
+
+		userData, err := base64.StdEncoding.DecodeString(fake.UserData(instances[0].InstanceId))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hasFlag := strings.Contains(string(userData), "-exec-allow")
+		if execAllow == nil && hasFlag {
+			t.Errorf("expected exec to stay disabled: %s", userData)
+		}
+		if execAllow != nil && !strings.Contains(string(userData), "-exec-allow='df,ss'") {
+			t.Errorf("expected the agent to allow df and ss: %s", userData)
+		}
+	}
+}
+
+func TestCreateComputeInstancesLaunchOrder(t *testing.T) {
+	ctx := context.Background()
+	svc, fake := newService(t)
+	fake.ReverseLaunchOrder = true
+
+	_, instances := deploy(t, ctx, svc, "a", 3)
+	// configs index the nodes by position, it has to be the node index
+	for nodeIndex, ci := range instances {
+		if agentId := fmt.Sprintf("a-node-%d", nodeIndex); ci.AgentId != agentId {
+			t.Errorf("expected %s at position %d, got %s", agentId, nodeIndex, ci.AgentId)
+		}
+	}
+}
+
+func TestTerminateComputeInstances(t *testing.T) {
+	ctx := context.Background()
+	svc, fake := newService(t)
+	fake.TransitionPolls = 2
+
+	securityGroupId, instances := deploy(t, ctx, svc, "a", 2)
+
+	// instances still use the group
+	if err := svc.DeleteSecurityGroup(ctx, securityGroupId); err == nil {
+		t.Fatalf("expected deleting a security group in use to fail")
+	}
+
+	instanceIds := []string{}
+	for _, ci := range instances {
+		instanceIds = append(instanceIds, ci.InstanceId)
+	}
+	if err := svc.TerminateComputeInstances(ctx, instanceIds); err != nil {
+		t.Fatalf("TerminateComputeInstances: %v", err)
+	}
+	for instanceId, state := range instanceStates(fake) {
+		if state != types.InstanceStateNameTerminated {
+			t.Errorf("expected instance %s to be terminated, got %s", instanceId, state)
+		}
+	}
+
+	if err := svc.DeleteSecurityGroup(ctx, securityGroupId); err != nil {
+		t.Fatalf("DeleteSecurityGroup: %v", err)
+	}
+	if groups := fake.SecurityGroups(); len(groups) != 0 {
+		t.Errorf("expected no security groups, got %d", len(groups))
+	}
+}
+
+func TestDiscoverResources(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newService(t)
+
+	securityGroupId, instances := deploy(t, ctx, svc, "a", 2)
+	_, others := deploy(t, ctx, svc, "b", 1)
+
+	// terminated instances are not discovered, even though they share the group
+	if err := svc.TerminateComputeInstances(ctx, []string{instances[0].InstanceId}); err != nil {
+		t.Fatalf("TerminateComputeInstances: %v", err)
+	}
+
+	instanceIds, securityGroupIds, err := svc.DiscoverResources(ctx, "a")
+	if err != nil {
+		t.Fatalf("DiscoverResources: %v", err)
+	}
+	if len(instanceIds) != 1 || instanceIds[0] != instances[1].InstanceId {
+		t.Errorf("expected to discover instance %s, got %v", instances[1].InstanceId, instanceIds)
+	}
+	if len(securityGroupIds) != 1 || securityGroupIds[0] != securityGroupId {
+		t.Errorf("expected to discover security group %s, got %v", securityGroupId, securityGroupIds)
+	}
+
+	resources, err := svc.ListResources(ctx)
+	if err != nil {
+		t.Fatalf("ListResources: %v", err)
+	}
+	clusters := map[string]int{}
+	for _, resource := range resources {
+		clusters[resource.ClusterId]++
+		if resource.Kind == cloud.ResourceInstance && resource.Id == instances[0].InstanceId {
+			t.Errorf("terminated instance %s listed", resource.Id)
+		}
+	}
+	// one instance and a group each
+	if clusters["a"] != 2 || clusters["b"] != 2 {
+		t.Errorf("expected 2 resources for clusters a and b, got %v", clusters)
+	}
+	if others[0].AgentId != "b-node-0" {
+		t.Errorf("expected agent b-node-0, got %s", others[0].AgentId)
+	}
+}
+
+func TestCreateComputeInstancesWithoutRelease(t *testing.T) {
+	ctx := context.Background()
+	fake := fakeec2.New()
+	// tests aren't built as a smithy release
+	svc := smithyaws.NewFromAPI(fake, smithyaws.Options{WaiterDelay: 10 * time.Millisecond})
+
+	if params := svc.Params(); params[smithyaws.ParamSmithyVersion] != "" {
+		t.Fatalf("expected no smithy version, got %s", params[smithyaws.ParamSmithyVersion])
+	}
+	// deploy-agents asks before it provisions anything
+	if err := svc.ValidateDeploy(); err == nil || !strings.Contains(err.Error(), smithyaws.ParamSmithyVersion) {
+		t.Fatalf("expected the deploy to be rejected without a smithy release, got %v", err)
+	}
+	if _, err := svc.CreateSecurityGroup(ctx, "smithy-sg-a", "a"); err != nil {
+		t.Fatalf("CreateSecurityGroup: %v", err)
+	}
+	_, err := svc.CreateComputeInstances(ctx, "smithy-sg-a", "smithy-compute-node-a", 1, credsFile(t), "a")
+	if err == nil || !strings.Contains(err.Error(), smithyaws.ParamSmithyVersion) {
+		t.Fatalf("expected deploying without a smithy release to fail, got %v", err)
+	}
+	if calls := fake.Calls("RunInstances"); calls != 0 {
+		t.Errorf("expected no instances to be launched, got %d RunInstances calls", calls)
+	}
+
+	svc = smithyaws.NewFromAPI(fake, smithyaws.Options{SmithyVersion: "v0.0.8"})
+	if version := svc.Params()[smithyaws.ParamSmithyVersion]; version != "0.0.8" {
+		t.Errorf("expected smithy version 0.0.8, got %s", version)
+	}
+	if err := svc.ValidateDeploy(); err != nil {
+		t.Errorf("expected the deploy to be valid, got %v", err)
+	}
+}
+
+func TestCreateComputeInstancesRunInstancesError(t *testing.T) {
+	ctx := context.Background()
+	svc, fake := newService(t)
+
+	if _, err := svc.CreateSecurityGroup(ctx, "smithy-sg-a", "a"); err != nil {
+		t.Fatalf("CreateSecurityGroup: %v", err)
+	}
+	fake.InjectError("RunInstances", errors.New("InsufficientInstanceCapacity"))
+
+	_, err := svc.CreateComputeInstances(ctx, "smithy-sg-a", "smithy-compute-node-a", 3, credsFile(t), "a")
+	if err == nil || !strings.Contains(err.Error(), "InsufficientInstanceCapacity") {
+		t.Fatalf("expected the RunInstances error, got %v", err)
+	}
+	if instances := fake.Instances(); len(instances) != 0 {
+		t.Errorf("expected no instances, got %d", len(instances))
+	}
+}
+
+func TestCreateComputeInstancesRollback(t *testing.T) {
+	ctx := context.Background()
+	svc, fake := newService(t)
+
+	if _, err := svc.CreateSecurityGroup(ctx, "smithy-sg-a", "a"); err != nil {
+		t.Fatalf("CreateSecurityGroup: %v", err)
+	}
+	// the instances are launched, tagging their node index fails
+	fake.InjectError("CreateTags", errors.New("RequestLimitExceeded"))
+
+	_, err := svc.CreateComputeInstances(ctx, "smithy-sg-a", "smithy-compute-node-a", 3, credsFile(t), "a")
+	if err == nil || !strings.Contains(err.Error(), "RequestLimitExceeded") {
+		t.Fatalf("expected the CreateTags error, got %v", err)
+	}
+	states := instanceStates(fake)
+	if len(states) != 3 {
+		t.Fatalf("expected 3 launched instances, got %d", len(states))
+	}
+	for instanceId, state := range states {
+		if state != types.InstanceStateNameTerminated {
+			t.Errorf("expected instance %s to be rolled back, got %s", instanceId, state)
+		}
+	}
+}
+
+func TestCreateComputeInstancesTimeout(t *testing.T) {
+	svc, fake := newService(t)
+	// pending for longer than the deploy may take
+	fake.TransitionPolls = 20
+
+	if _, err := svc.CreateSecurityGroup(context.Background(), "smithy-sg-a", "a"); err != nil {
+		t.Fatalf("CreateSecurityGroup: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := svc.CreateComputeInstances(ctx, "smithy-sg-a", "smithy-compute-node-a", 2, credsFile(t), "a")
+	if err == nil {
+		t.Fatalf("expected the deploy to time out")
+	}
+	// the node index is tagged before waiting, so gc and the reaper see it on
+	// instances a rollback didn't get to
+	for _, instance := range fake.Instances() {
+		if nodeIndex := tagValue(instance.Tags, smithyaws.TagNodeIndex); nodeIndex == "" {
+			t.Errorf("instance %s has no node index tag", aws.ToString(instance.InstanceId))
+		}
+	}
+	// the rollback doesn't run on the expired context
+	states := instanceStates(fake)
+	if len(states) != 2 {
+		t.Fatalf("expected 2 launched instances, got %d", len(states))
+	}
+	for instanceId, state := range states {
+		if state != types.InstanceStateNameTerminated {
+			t.Errorf("expected instance %s to be rolled back, got %s", instanceId, state)
+		}
+	}
+}
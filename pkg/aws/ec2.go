@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"os"
 	"smithy/pkg/cloud"
+	"sort"
+	"strings"
 	"text/template"
 	"time"
 
@@ -16,18 +18,25 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 )
 
-const (
-	// TODO: make parameter
-	imageAmiId = "ami-0e83be366243f524a"
-)
-
 var (
 	//go:embed cloud-init.yml.tmpl
 	CloudInitTemplate string
 )
 
+const (
+	// TODO: make parameter or constant
+	instanceWaitTime = 10 * time.Minute
+	// how long rolling back a failed launch may take, it doesn't run on the
+	// (possibly expired) caller's context
+	rollbackTimeout = 10 * time.Minute
+)
+
 func (awsClient *AwsService) CreateComputeInstances(ctx context.Context, securityGroupName string, instanceTagName string, instanceCount int32, credsPath string, clusterId string) ([]cloud.ComputeInstance, error) {
 
+	if awsClient.opts.SmithyVersion == "" {
+		return nil, errSmithyVersion
+	}
+
 	// read creds file
 	creds, err := os.ReadFile(credsPath)
 	if err != nil {
@@ -35,67 +44,93 @@ func (awsClient *AwsService) CreateComputeInstances(ctx context.Context, securit
 	}
 	credsStr := base64.StdEncoding.EncodeToString(creds)
 
-	for instanceId := 0; instanceId < int(instanceCount); instanceId++ {
+	// every node gets the same user data, nodes derive their id from their launch index
+	cloudInitParams := map[string]string{
+		"Creds":         credsStr,
+		"ClusterId":     clusterId,
+		"SmithyVersion": awsClient.opts.SmithyVersion,
+		"ExecAllow":     strings.Join(awsClient.opts.ExecAllow, ","),
+	}
 
-		cloudInitParams := map[string]string{
-			"Creds":      credsStr,
-			"ClusterId":  clusterId,
-			"InstanceId": fmt.Sprintf("%s-node-%d", clusterId, instanceId),
-		}
+	// template cloud-init
+	buffer := bytes.NewBuffer([]byte{})
+	cloudInitTemplate := template.Must(template.New("cloud-init").Parse(CloudInitTemplate))
+	if err = cloudInitTemplate.Execute(buffer, cloudInitParams); err != nil {
+		return nil, fmt.Errorf("unable to template cloud-init, %v", err)
+	}
+	b64UserData := base64.StdEncoding.EncodeToString(buffer.Bytes())
 
-		// template cloud-init
-		buffer := bytes.NewBuffer([]byte{})
-		cloudInitTemplate := template.Must(template.New("cloud-init").Parse(CloudInitTemplate))
-		if err = cloudInitTemplate.Execute(buffer, cloudInitParams); err != nil {
-			return nil, fmt.Errorf("unable to template cloud-init, %v", err)
-		}
-		cloudInitBytes := buffer.Bytes()
-		//fmt.Println(string(cloudInitBytes))
-
-		b64UserData := base64.StdEncoding.EncodeToString(cloudInitBytes)
-
-		// create instances
-		_, err = awsClient.svc.RunInstances(ctx, &ec2.RunInstancesInput{
-			SecurityGroups: []string{securityGroupName},
-			TagSpecifications: []types.TagSpecification{
-				{
-					ResourceType: types.ResourceTypeInstance,
-					Tags: []types.Tag{
-						{
-							Key:   aws.String("Name"),
-							Value: aws.String(instanceTagName),
-						},
-					},
-				},
+	// launch all instances at once, either all of them start or none
+	runInstancesResp, err := awsClient.svc.RunInstances(ctx, &ec2.RunInstancesInput{
+		SecurityGroups: []string{securityGroupName},
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeInstance,
+				Tags: append(clusterTags(clusterId), types.Tag{
+					Key:   aws.String("Name"),
+					Value: aws.String(instanceTagName),
+				}),
 			},
-			ImageId:      aws.String(imageAmiId),
-			InstanceType: types.InstanceTypeT2Micro,
-			MinCount:     aws.Int32(1),
-			MaxCount:     aws.Int32(1),
-			// TODO: put in a better key or use ec2instanceconnect
-			KeyName:  aws.String("reuben-dev"),
-			UserData: aws.String(b64UserData),
-		})
-		if err != nil {
-			return nil, fmt.Errorf("unable to run instance(s), %v", err)
-		}
+			{
+				ResourceType: types.ResourceTypeVolume,
+				Tags:         clusterTags(clusterId),
+			},
+		},
+		ImageId:      aws.String(awsClient.opts.ImageId),
+		InstanceType: types.InstanceType(awsClient.opts.InstanceType),
+		MinCount:     aws.Int32(instanceCount),
+		MaxCount:     aws.Int32(instanceCount),
+		KeyName:      aws.String(awsClient.opts.KeyName),
+		UserData:     aws.String(b64UserData),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to run instance(s), %v", err)
 	}
 
-	// get all instance ids by filtering by security group name
-	instanceIds, err := awsClient.GetEc2InstanceIdsFromSecurityGroupName(ctx, securityGroupName)
+	instanceIds := []string{}
+	for _, instance := range runInstancesResp.Instances {
+		instanceIds = append(instanceIds, *instance.InstanceId)
+	}
+
+	computeInstances, err := awsClient.waitForComputeInstances(ctx, runInstancesResp.Instances, clusterId)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get instance ids from security group name, %v", err)
+		// don't leave anything running that no cluster record will point at
+		rollbackCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+		defer cancel()
+		if terminateErr := awsClient.TerminateComputeInstances(rollbackCtx, instanceIds); terminateErr != nil {
+			return nil, fmt.Errorf("%v (rolling back instances %v also failed: %v)", err, instanceIds, terminateErr)
+		}
+		return nil, fmt.Errorf("%v (terminated instances %v)", err, instanceIds)
+	}
+	return computeInstances, nil
+}
+
+// waitForComputeInstances waits for the launched instances to be running and describes them
+func (awsClient *AwsService) waitForComputeInstances(ctx context.Context, instances []types.Instance, clusterId string) ([]cloud.ComputeInstance, error) {
+
+	// a batched launch tags every instance alike, the node index is tagged before
+	// waiting so the instances of deploys that time out or are interrupted have it
+	instanceIds := []string{}
+	for _, instance := range instances {
+		instanceIds = append(instanceIds, aws.ToString(instance.InstanceId))
+		if err := awsClient.tagNodeIndex(ctx, aws.ToInt32(instance.AmiLaunchIndex), aws.ToString(instance.InstanceId)); err != nil {
+			return nil, err
+		}
 	}
 
 	// wait for instances to be in status ok
-	if err = ec2.NewInstanceRunningWaiter(awsClient.svc).
+	if err := ec2.NewInstanceRunningWaiter(awsClient.svc).
 		Wait(
-			context.TODO(),
+			ctx,
 			&ec2.DescribeInstancesInput{
 				InstanceIds: instanceIds,
 			},
-			// TODO: make parameter or constant
-			10*time.Minute,
+			instanceWaitTime,
+			func(o *ec2.InstanceRunningWaiterOptions) {
+				if awsClient.opts.WaiterDelay > 0 {
+					o.MinDelay, o.MaxDelay = awsClient.opts.WaiterDelay, awsClient.opts.WaiterDelay
+				}
+			},
 		); err != nil {
 		return nil, fmt.Errorf("failed to wait for instances to be in status ok, %v", err)
 	}
@@ -109,27 +144,46 @@ func (awsClient *AwsService) CreateComputeInstances(ctx context.Context, securit
 	if err != nil {
 		return nil, fmt.Errorf("unable to describe instances, %v", err)
 	}
+	// ordered by launch index, which is the node index
+	described := []types.Instance{}
 	for _, reservation := range describeInstancesResp.Reservations {
-		for _, instance := range reservation.Instances {
-			ec2Instances = append(ec2Instances, cloud.ComputeInstance{
-				DnsName:    *instance.PublicDnsName,
-				InstanceId: *instance.InstanceId,
-				PrivateIp:  *instance.PrivateIpAddress,
-				PublicIp:   *instance.PublicIpAddress,
-			})
+		described = append(described, reservation.Instances...)
+	}
+	sort.SliceStable(described, func(i, j int) bool {
+		return aws.ToInt32(described[i].AmiLaunchIndex) < aws.ToInt32(described[j].AmiLaunchIndex)
+	})
+	for _, instance := range described {
+		// volumes are only known once the instance runs
+		volumeIds := []string{}
+		for _, blockDevice := range instance.BlockDeviceMappings {
+			if blockDevice.Ebs != nil && blockDevice.Ebs.VolumeId != nil {
+				volumeIds = append(volumeIds, *blockDevice.Ebs.VolumeId)
+			}
+		}
+		if len(volumeIds) > 0 {
+			if err = awsClient.tagNodeIndex(ctx, aws.ToInt32(instance.AmiLaunchIndex), volumeIds...); err != nil {
+				return nil, err
+			}
 		}
+		ec2Instances = append(ec2Instances, cloud.ComputeInstance{
+			DnsName:    aws.ToString(instance.PublicDnsName),
+			InstanceId: aws.ToString(instance.InstanceId),
+			PrivateIp:  aws.ToString(instance.PrivateIpAddress),
+			PublicIp:   aws.ToString(instance.PublicIpAddress),
+			// matches the id the node gives itself in cloud-init
+			AgentId: fmt.Sprintf("%s-node-%d", clusterId, aws.ToInt32(instance.AmiLaunchIndex)),
+		})
 	}
 	return ec2Instances, nil
 }
 
-func (awsClient *AwsService) GetEc2InstanceIdsFromSecurityGroupName(ctx context.Context, securityGroupName string) ([]string, error) {
+// GetEc2InstanceIdsFromClusterId finds the instances of a cluster that are not
+// terminated or shutting down
+func (awsClient *AwsService) GetEc2InstanceIdsFromClusterId(ctx context.Context, clusterId string) ([]string, error) {
 	describeInstancesResp, err := awsClient.svc.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
 		Filters: []types.Filter{
-			{
-				// filter by security group name
-				Name:   aws.String("instance.group-name"),
-				Values: []string{securityGroupName},
-			},
+			clusterFilter(clusterId),
+			liveInstancesFilter(),
 		},
 	})
 	if err != nil {
@@ -158,8 +212,12 @@ func (awsClient *AwsService) TerminateComputeInstances(ctx context.Context, inst
 			ctx, &ec2.DescribeInstancesInput{
 				InstanceIds: instanceIds,
 			},
-			// TODO: make parameter or constant
-			10*time.Minute,
+			instanceWaitTime,
+			func(o *ec2.InstanceTerminatedWaiterOptions) {
+				if awsClient.opts.WaiterDelay > 0 {
+					o.MinDelay, o.MaxDelay = awsClient.opts.WaiterDelay, awsClient.opts.WaiterDelay
+				}
+			},
 		); err != nil {
 		return fmt.Errorf("failed to wait for instances to be terminated, %v", err)
 	}
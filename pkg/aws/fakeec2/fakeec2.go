@@ -0,0 +1,549 @@
+// Package fakeec2 is an in-memory implementation of aws.EC2API. Instances move
+// through their lifecycle states as they are described, which lets the SDK
+// waiters used by the aws package complete without talking to AWS.
+package fakeec2
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	smithyaws "smithy/pkg/aws"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+)
+
+var _ smithyaws.EC2API = (*EC2)(nil)
+
+type instance struct {
+	instance types.Instance
+	// number of describe calls left before the instance leaves a transitional state
+	pendingPolls int
+	// base64 encoded, as launched
+	userData string
+}
+
+type securityGroup struct {
+	group types.SecurityGroup
+}
+
+// EC2 is safe for concurrent use
+type EC2 struct {
+	// TransitionPolls is how many DescribeInstances calls an instance stays in
+	// the pending and shutting-down states
+	TransitionPolls int
+	// ReverseLaunchOrder lists launched instances last launch index first, ec2
+	// doesn't promise any order
+	ReverseLaunchOrder bool
+
+	mu             sync.Mutex
+	instances      map[string]*instance
+	instanceOrder  []string
+	securityGroups map[string]*securityGroup
+	// volume tags by volume id, every instance gets one root volume
+	volumes      map[string][]types.Tag
+	reservations int
+	errors       map[string][]error
+	calls        map[string]int
+}
+
+func New() *EC2 {
+	return &EC2{
+		TransitionPolls: 1,
+		instances:       map[string]*instance{},
+		securityGroups:  map[string]*securityGroup{},
+		volumes:         map[string][]types.Tag{},
+		errors:          map[string][]error{},
+		calls:           map[string]int{},
+	}
+}
+
+// InjectError makes the next call to the named operation, e.g. "RunInstances",
+// fail with err. Errors queue up when injected several times.
+func (f *EC2) InjectError(operation string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors[operation] = append(f.errors[operation], err)
+}
+
+// Calls returns how many times the named operation was invoked
+func (f *EC2) Calls(operation string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[operation]
+}
+
+// Instances returns a snapshot of every instance ever launched, terminated ones included
+func (f *EC2) Instances() []types.Instance {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	instances := []types.Instance{}
+	for _, instanceId := range f.instanceOrder {
+		instances = append(instances, f.instances[instanceId].instance)
+	}
+	return instances
+}
+
+// UserData returns the base64 encoded user data an instance was launched with
+func (f *EC2) UserData(instanceId string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if i, ok := f.instances[instanceId]; ok {
+		return i.userData
+	}
+	return ""
+}
+
+// SecurityGroups returns a snapshot of the existing security groups
+func (f *EC2) SecurityGroups() []types.SecurityGroup {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	groups := []types.SecurityGroup{}
+	for _, sg := range f.securityGroups {
+		groups = append(groups, sg.group)
+	}
+	return groups
+}
+
+// VolumeTags returns the tags of every volume by volume id
+func (f *EC2) VolumeTags() map[string][]types.Tag {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	volumes := map[string][]types.Tag{}
+	for volumeId, tags := range f.volumes {
+		volumes[volumeId] = append([]types.Tag{}, tags...)
+	}
+	return volumes
+}
+
+// call records an invocation and returns the next injected error, if any
+func (f *EC2) call(operation string) error {
+	f.calls[operation]++
+	if errs := f.errors[operation]; len(errs) > 0 {
+		f.errors[operation] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+func apiError(code string, format string, args ...interface{}) error {
+	return &smithy.GenericAPIError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (f *EC2) findSecurityGroup(nameOrId string) *securityGroup {
+	if sg, ok := f.securityGroups[nameOrId]; ok {
+		return sg
+	}
+	for _, sg := range f.securityGroups {
+		if aws.ToString(sg.group.GroupName) == nameOrId {
+			return sg
+		}
+	}
+	return nil
+}
+
+func (f *EC2) RunInstances(ctx context.Context, params *ec2.RunInstancesInput, optFns ...func(*ec2.Options)) (*ec2.RunInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("RunInstances"); err != nil {
+		return nil, err
+	}
+
+	minCount, maxCount := aws.ToInt32(params.MinCount), aws.ToInt32(params.MaxCount)
+	if minCount < 1 || maxCount < minCount {
+		return nil, apiError("InvalidParameterValue", "invalid instance count min %d max %d", minCount, maxCount)
+	}
+
+	groups := []types.GroupIdentifier{}
+	for _, name := range params.SecurityGroups {
+		sg := f.findSecurityGroup(name)
+		if sg == nil {
+			return nil, apiError("InvalidGroup.NotFound", "the security group '%s' does not exist", name)
+		}
+		groups = append(groups, types.GroupIdentifier{GroupId: sg.group.GroupId, GroupName: sg.group.GroupName})
+	}
+	for _, groupId := range params.SecurityGroupIds {
+		sg := f.findSecurityGroup(groupId)
+		if sg == nil {
+			return nil, apiError("InvalidGroup.NotFound", "the security group '%s' does not exist", groupId)
+		}
+		groups = append(groups, types.GroupIdentifier{GroupId: sg.group.GroupId, GroupName: sg.group.GroupName})
+	}
+
+	tags, volumeTags := []types.Tag{}, []types.Tag{}
+	for _, spec := range params.TagSpecifications {
+		switch spec.ResourceType {
+		case types.ResourceTypeInstance:
+			tags = append(tags, spec.Tags...)
+		case types.ResourceTypeVolume:
+			volumeTags = append(volumeTags, spec.Tags...)
+		}
+	}
+
+	f.reservations++
+	output := &ec2.RunInstancesOutput{
+		ReservationId: aws.String(fmt.Sprintf("r-%017x", f.reservations)),
+	}
+	for launchIndex := int32(0); launchIndex < maxCount; launchIndex++ {
+		n := len(f.instanceOrder) + 1
+		instanceId := fmt.Sprintf("i-%017x", n)
+		volumeId := fmt.Sprintf("vol-%017x", n)
+		f.volumes[volumeId] = append([]types.Tag{}, volumeTags...)
+		ec2Instance := types.Instance{
+			InstanceId:       aws.String(instanceId),
+			ImageId:          params.ImageId,
+			InstanceType:     params.InstanceType,
+			KeyName:          params.KeyName,
+			LaunchTime:       aws.Time(time.Now()),
+			AmiLaunchIndex:   aws.Int32(launchIndex),
+			PrivateIpAddress: aws.String(fmt.Sprintf("10.0.%d.%d", n/256, n%256)),
+			PublicIpAddress:  aws.String(fmt.Sprintf("3.0.%d.%d", n/256, n%256)),
+			PublicDnsName:    aws.String(fmt.Sprintf("ec2-3-0-%d-%d.compute.amazonaws.com", n/256, n%256)),
+			SecurityGroups:   groups,
+			Tags:             append([]types.Tag{}, tags...),
+			State:            &types.InstanceState{Name: types.InstanceStateNamePending},
+			BlockDeviceMappings: []types.InstanceBlockDeviceMapping{
+				{
+					DeviceName: aws.String("/dev/sda1"),
+					Ebs:        &types.EbsInstanceBlockDevice{VolumeId: aws.String(volumeId)},
+				},
+			},
+		}
+		f.instances[instanceId] = &instance{instance: ec2Instance, pendingPolls: f.TransitionPolls, userData: aws.ToString(params.UserData)}
+		f.instanceOrder = append(f.instanceOrder, instanceId)
+		output.Instances = append(output.Instances, ec2Instance)
+	}
+	if f.ReverseLaunchOrder {
+		slices.Reverse(output.Instances)
+	}
+	return output, nil
+}
+
+func (f *EC2) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeInstances"); err != nil {
+		return nil, err
+	}
+
+	for _, instanceId := range params.InstanceIds {
+		if _, ok := f.instances[instanceId]; !ok {
+			return nil, apiError("InvalidInstanceID.NotFound", "the instance ID '%s' does not exist", instanceId)
+		}
+	}
+
+	// advance every instance in a transitional state
+	for _, i := range f.instances {
+		switch i.instance.State.Name {
+		case types.InstanceStateNamePending, types.InstanceStateNameShuttingDown:
+			if i.pendingPolls > 0 {
+				i.pendingPolls--
+				continue
+			}
+			if i.instance.State.Name == types.InstanceStateNamePending {
+				i.instance.State = &types.InstanceState{Name: types.InstanceStateNameRunning}
+			} else {
+				i.instance.State = &types.InstanceState{Name: types.InstanceStateNameTerminated}
+			}
+		}
+	}
+
+	instanceIds := params.InstanceIds
+	if len(instanceIds) == 0 {
+		instanceIds = f.instanceOrder
+	}
+
+	reservation := types.Reservation{}
+	for _, instanceId := range instanceIds {
+		i := f.instances[instanceId]
+		if matchesFilters(i.instance, params.Filters) {
+			reservation.Instances = append(reservation.Instances, i.instance)
+		}
+	}
+	output := &ec2.DescribeInstancesOutput{}
+	if len(reservation.Instances) > 0 {
+		output.Reservations = []types.Reservation{reservation}
+	}
+	return output, nil
+}
+
+// matchesFilters supports the instance filters used by smithy
+func matchesFilters(i types.Instance, filters []types.Filter) bool {
+	for _, filter := range filters {
+		name := aws.ToString(filter.Name)
+		values := []string{}
+		switch {
+		case name == "instance-id":
+			values = append(values, aws.ToString(i.InstanceId))
+		case name == "instance-state-name":
+			values = append(values, string(i.State.Name))
+		case name == "instance.group-name" || name == "group-name":
+			for _, group := range i.SecurityGroups {
+				values = append(values, aws.ToString(group.GroupName))
+			}
+		case name == "instance.group-id" || name == "group-id":
+			for _, group := range i.SecurityGroups {
+				values = append(values, aws.ToString(group.GroupId))
+			}
+		default:
+			var ok bool
+			if values, ok = tagFilterValues(name, i.Tags); !ok {
+				// unknown filters never match, like an unsupported filter would fail on AWS
+				return false
+			}
+		}
+		if !anyMatch(values, filter.Values) {
+			return false
+		}
+	}
+	return true
+}
+
+// securityGroupMatchesFilters supports the security group filters used by smithy
+func securityGroupMatchesFilters(sg types.SecurityGroup, filters []types.Filter) bool {
+	for _, filter := range filters {
+		name := aws.ToString(filter.Name)
+		values := []string{}
+		switch name {
+		case "group-name":
+			values = append(values, aws.ToString(sg.GroupName))
+		case "group-id":
+			values = append(values, aws.ToString(sg.GroupId))
+		default:
+			var ok bool
+			if values, ok = tagFilterValues(name, sg.Tags); !ok {
+				return false
+			}
+		}
+		if !anyMatch(values, filter.Values) {
+			return false
+		}
+	}
+	return true
+}
+
+// tagFilterValues returns the values a tag filter compares against
+func tagFilterValues(name string, tags []types.Tag) ([]string, bool) {
+	values := []string{}
+	switch {
+	case name == "tag-key":
+		for _, tag := range tags {
+			values = append(values, aws.ToString(tag.Key))
+		}
+	case strings.HasPrefix(name, "tag:"):
+		for _, tag := range tags {
+			if aws.ToString(tag.Key) == strings.TrimPrefix(name, "tag:") {
+				values = append(values, aws.ToString(tag.Value))
+			}
+		}
+	default:
+		return nil, false
+	}
+	return values, true
+}
+
+// anyMatch compares like AWS filters do, * and ? in wanted values are wildcards
+func anyMatch(values []string, wanted []string) bool {
+	for _, value := range values {
+		for _, w := range wanted {
+			if matched, _ := path.Match(w, value); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *EC2) TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("TerminateInstances"); err != nil {
+		return nil, err
+	}
+
+	for _, instanceId := range params.InstanceIds {
+		if _, ok := f.instances[instanceId]; !ok {
+			return nil, apiError("InvalidInstanceID.NotFound", "the instance ID '%s' does not exist", instanceId)
+		}
+	}
+
+	output := &ec2.TerminateInstancesOutput{}
+	for _, instanceId := range params.InstanceIds {
+		i := f.instances[instanceId]
+		previous := i.instance.State
+		if previous.Name != types.InstanceStateNameTerminated {
+			i.instance.State = &types.InstanceState{Name: types.InstanceStateNameShuttingDown}
+			i.pendingPolls = f.TransitionPolls
+		}
+		output.TerminatingInstances = append(output.TerminatingInstances, types.InstanceStateChange{
+			InstanceId:    aws.String(instanceId),
+			PreviousState: previous,
+			CurrentState:  i.instance.State,
+		})
+	}
+	return output, nil
+}
+
+func (f *EC2) CreateSecurityGroup(ctx context.Context, params *ec2.CreateSecurityGroupInput, optFns ...func(*ec2.Options)) (*ec2.CreateSecurityGroupOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateSecurityGroup"); err != nil {
+		return nil, err
+	}
+
+	name := aws.ToString(params.GroupName)
+	if f.findSecurityGroup(name) != nil {
+		return nil, apiError("InvalidGroup.Duplicate", "the security group '%s' already exists", name)
+	}
+
+	tags := []types.Tag{}
+	for _, spec := range params.TagSpecifications {
+		if spec.ResourceType == types.ResourceTypeSecurityGroup {
+			tags = append(tags, spec.Tags...)
+		}
+	}
+
+	groupId := fmt.Sprintf("sg-%017x", f.calls["CreateSecurityGroup"])
+	f.securityGroups[groupId] = &securityGroup{group: types.SecurityGroup{
+		GroupId:     aws.String(groupId),
+		GroupName:   params.GroupName,
+		Description: params.Description,
+		Tags:        tags,
+	}}
+	return &ec2.CreateSecurityGroupOutput{GroupId: aws.String(groupId), Tags: tags}, nil
+}
+
+func (f *EC2) DescribeSecurityGroups(ctx context.Context, params *ec2.DescribeSecurityGroupsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeSecurityGroups"); err != nil {
+		return nil, err
+	}
+
+	groups := []types.SecurityGroup{}
+	if len(params.GroupIds) == 0 && len(params.GroupNames) == 0 {
+		for _, sg := range f.securityGroups {
+			groups = append(groups, sg.group)
+		}
+	}
+	for _, nameOrId := range append(append([]string{}, params.GroupIds...), params.GroupNames...) {
+		sg := f.findSecurityGroup(nameOrId)
+		if sg == nil {
+			return nil, apiError("InvalidGroup.NotFound", "the security group '%s' does not exist", nameOrId)
+		}
+		groups = append(groups, sg.group)
+	}
+
+	output := &ec2.DescribeSecurityGroupsOutput{}
+	for _, group := range groups {
+		if securityGroupMatchesFilters(group, params.Filters) {
+			output.SecurityGroups = append(output.SecurityGroups, group)
+		}
+	}
+	return output, nil
+}
+
+func (f *EC2) AuthorizeSecurityGroupIngress(ctx context.Context, params *ec2.AuthorizeSecurityGroupIngressInput, optFns ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("AuthorizeSecurityGroupIngress"); err != nil {
+		return nil, err
+	}
+
+	groupId := aws.ToString(params.GroupId)
+	if groupId == "" {
+		groupId = aws.ToString(params.GroupName)
+	}
+	sg := f.findSecurityGroup(groupId)
+	if sg == nil {
+		return nil, apiError("InvalidGroup.NotFound", "the security group '%s' does not exist", groupId)
+	}
+	sg.group.IpPermissions = append(sg.group.IpPermissions, params.IpPermissions...)
+	return &ec2.AuthorizeSecurityGroupIngressOutput{Return: aws.Bool(true)}, nil
+}
+
+func (f *EC2) DeleteSecurityGroup(ctx context.Context, params *ec2.DeleteSecurityGroupInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSecurityGroupOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteSecurityGroup"); err != nil {
+		return nil, err
+	}
+
+	groupId := aws.ToString(params.GroupId)
+	if groupId == "" {
+		groupId = aws.ToString(params.GroupName)
+	}
+	sg := f.findSecurityGroup(groupId)
+	if sg == nil {
+		return nil, apiError("InvalidGroup.NotFound", "the security group '%s' does not exist", groupId)
+	}
+
+	// like EC2, refuse while instances that aren't terminated still use the group
+	for _, i := range f.instances {
+		if i.instance.State.Name == types.InstanceStateNameTerminated {
+			continue
+		}
+		for _, group := range i.instance.SecurityGroups {
+			if aws.ToString(group.GroupId) == aws.ToString(sg.group.GroupId) {
+				return nil, apiError("DependencyViolation", "resource %s has a dependent object", aws.ToString(sg.group.GroupId))
+			}
+		}
+	}
+	delete(f.securityGroups, aws.ToString(sg.group.GroupId))
+	return &ec2.DeleteSecurityGroupOutput{}, nil
+}
+
+func (f *EC2) CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateTags"); err != nil {
+		return nil, err
+	}
+
+	// validate everything first, so a failing call tags nothing
+	for _, resourceId := range params.Resources {
+		_, isInstance := f.instances[resourceId]
+		_, isGroup := f.securityGroups[resourceId]
+		_, isVolume := f.volumes[resourceId]
+		if !isInstance && !isGroup && !isVolume {
+			return nil, apiError("InvalidID", "the ID '%s' is not valid", resourceId)
+		}
+	}
+
+	for _, resourceId := range params.Resources {
+		if i, ok := f.instances[resourceId]; ok {
+			i.instance.Tags = setTags(i.instance.Tags, params.Tags)
+		}
+		if sg, ok := f.securityGroups[resourceId]; ok {
+			sg.group.Tags = setTags(sg.group.Tags, params.Tags)
+		}
+		if tags, ok := f.volumes[resourceId]; ok {
+			f.volumes[resourceId] = setTags(tags, params.Tags)
+		}
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+// setTags adds tags, overwriting the values of existing keys
+func setTags(tags []types.Tag, newTags []types.Tag) []types.Tag {
+	merged := append([]types.Tag{}, tags...)
+	for _, newTag := range newTags {
+		replaced := false
+		for i := range merged {
+			if aws.ToString(merged[i].Key) == aws.ToString(newTag.Key) {
+				merged[i].Value = newTag.Value
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged = append(merged, newTag)
+		}
+	}
+	return merged
+}
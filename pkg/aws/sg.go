@@ -3,6 +3,7 @@ package aws
 import (
 	"context"
 	"fmt"
+	"smithy/pkg/cloud"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -20,12 +21,18 @@ func (awsClient *AwsService) DeleteSecurityGroup(ctx context.Context, securityGr
 	return nil
 }
 
-func (awsClient *AwsService) CreateSecurityGroup(ctx context.Context, securityGroupName string) (securityGroupId string, err error) {
+func (awsClient *AwsService) CreateSecurityGroup(ctx context.Context, securityGroupName string, clusterId string) (securityGroupId string, err error) {
 
 	// create security group
 	securityGroup, err := awsClient.svc.CreateSecurityGroup(ctx, &ec2.CreateSecurityGroupInput{
 		Description: aws.String("temp nats cluster security group"),
 		GroupName:   aws.String(securityGroupName),
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeSecurityGroup,
+				Tags:         clusterTags(clusterId),
+			},
+		},
 	})
 	if err != nil {
 		return
@@ -38,7 +45,11 @@ func (awsClient *AwsService) CreateSecurityGroup(ctx context.Context, securityGr
 	// wait for security group to be created
 	if err = ec2.NewSecurityGroupExistsWaiter(awsClient.svc).Wait(ctx, &ec2.DescribeSecurityGroupsInput{
 		GroupIds: []string{securityGroupId},
-	}, waitTime); err != nil {
+	}, waitTime, func(o *ec2.SecurityGroupExistsWaiterOptions) {
+		if awsClient.opts.WaiterDelay > 0 {
+			o.MinDelay, o.MaxDelay = awsClient.opts.WaiterDelay, awsClient.opts.WaiterDelay
+		}
+	}); err != nil {
 		err = fmt.Errorf("security group %s never became available after %f minutes: %v", securityGroupId, waitTime.Minutes(), err)
 		return
 	}
@@ -55,8 +66,8 @@ func (awsClient *AwsService) CreateSecurityGroup(ctx context.Context, securityGr
 						Description: aws.String("NATS port for inbound traffic"),
 					},
 				},
-				FromPort:   aws.Int32(4222),
-				ToPort:     aws.Int32(4222),
+				FromPort:   aws.Int32(cloud.DefaultClientPort),
+				ToPort:     aws.Int32(cloud.DefaultClientPort),
 				IpProtocol: aws.String("tcp"),
 			},
 			{
@@ -66,8 +77,8 @@ func (awsClient *AwsService) CreateSecurityGroup(ctx context.Context, securityGr
 						Description: aws.String("NATS port for clustering"),
 					},
 				},
-				FromPort:   aws.Int32(6222),
-				ToPort:     aws.Int32(6222),
+				FromPort:   aws.Int32(cloud.DefaultClusterPort),
+				ToPort:     aws.Int32(cloud.DefaultClusterPort),
 				IpProtocol: aws.String("tcp"),
 			},
 			{
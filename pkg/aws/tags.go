@@ -0,0 +1,179 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"smithy/internal/meta"
+	"smithy/pkg/cloud"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// tags put on every resource smithy creates
+const (
+	TagClusterId = "smithy:cluster-id"
+	TagNodeIndex = "smithy:node-index"
+	TagCreatedBy = "smithy:created-by"
+	TagCreatedAt = "smithy:created-at"
+)
+
+// clusterTags are the tags shared by all resources of a cluster
+func clusterTags(clusterId string) []types.Tag {
+	return []types.Tag{
+		{Key: aws.String(TagClusterId), Value: aws.String(clusterId)},
+		{Key: aws.String(TagCreatedBy), Value: aws.String(cloud.Operator())},
+		{Key: aws.String(TagCreatedAt), Value: aws.String(time.Now().UTC().Format(time.RFC3339))},
+	}
+}
+
+func tagValue(tags []types.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == key {
+			return aws.ToString(tag.Value)
+		}
+	}
+	return ""
+}
+
+// clusterFilter matches the resources of a cluster
+func clusterFilter(clusterId string) types.Filter {
+	return types.Filter{
+		Name:   aws.String("tag:" + TagClusterId),
+		Values: []string{clusterId},
+	}
+}
+
+// liveInstancesFilter skips instances that are gone or on their way out
+func liveInstancesFilter() types.Filter {
+	return types.Filter{
+		Name: aws.String("instance-state-name"),
+		Values: []string{
+			string(types.InstanceStateNamePending),
+			string(types.InstanceStateNameRunning),
+			string(types.InstanceStateNameStopping),
+			string(types.InstanceStateNameStopped),
+		},
+	}
+}
+
+// tagNodeIndex tags resources of a node, its instance or volumes, with the node's launch index
+func (awsClient *AwsService) tagNodeIndex(ctx context.Context, launchIndex int32, resourceIds ...string) error {
+	_, err := awsClient.svc.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: resourceIds,
+		Tags: []types.Tag{
+			{Key: aws.String(TagNodeIndex), Value: aws.String(strconv.Itoa(int(launchIndex)))},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to tag %v, %v", resourceIds, err)
+	}
+	return nil
+}
+
+// DiscoverResources finds the live instances and the security groups of a cluster by their tags
+func (awsClient *AwsService) DiscoverResources(ctx context.Context, clusterId string) (instanceIds []string, securityGroupIds []string, err error) {
+	instanceIds, err = awsClient.GetEc2InstanceIdsFromClusterId(ctx, clusterId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	describeSecurityGroupsResp, err := awsClient.svc.DescribeSecurityGroups(ctx, &ec2.DescribeSecurityGroupsInput{
+		Filters: []types.Filter{clusterFilter(clusterId)},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to describe security groups, %v", err)
+	}
+	securityGroupIds = []string{}
+	for _, securityGroup := range describeSecurityGroupsResp.SecurityGroups {
+		securityGroupIds = append(securityGroupIds, aws.ToString(securityGroup.GroupId))
+	}
+	return instanceIds, securityGroupIds, nil
+}
+
+// ListResources finds the live instances and the security groups of every smithy
+// cluster in the region, by tag or, for resources created before tagging, by name
+func (awsClient *AwsService) ListResources(ctx context.Context) ([]cloud.Resource, error) {
+	resources := []cloud.Resource{}
+	seen := map[string]bool{}
+
+	for _, filter := range []types.Filter{
+		{Name: aws.String("tag-key"), Values: []string{TagClusterId}},
+		{Name: aws.String("tag:Name"), Values: []string{meta.InstanceTagNamePrefix + "-*"}},
+	} {
+		describeInstancesResp, err := awsClient.svc.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+			Filters: []types.Filter{filter, liveInstancesFilter()},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to describe instances, %v", err)
+		}
+		for _, reservation := range describeInstancesResp.Reservations {
+			for _, instance := range reservation.Instances {
+				instanceId := aws.ToString(instance.InstanceId)
+				if seen[instanceId] {
+					continue
+				}
+				seen[instanceId] = true
+				name := tagValue(instance.Tags, "Name")
+				resources = append(resources, cloud.Resource{
+					Kind:      cloud.ResourceInstance,
+					Id:        instanceId,
+					Name:      name,
+					ClusterId: resourceClusterId(instance.Tags, name, meta.InstanceTagNamePrefix),
+					CreatedAt: aws.ToTime(instance.LaunchTime),
+				})
+			}
+		}
+	}
+
+	for _, filter := range []types.Filter{
+		{Name: aws.String("tag-key"), Values: []string{TagClusterId}},
+		{Name: aws.String("group-name"), Values: []string{meta.SecurityGroupNamePrefix + "-*"}},
+	} {
+		describeSecurityGroupsResp, err := awsClient.svc.DescribeSecurityGroups(ctx, &ec2.DescribeSecurityGroupsInput{
+			Filters: []types.Filter{filter},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to describe security groups, %v", err)
+		}
+		for _, securityGroup := range describeSecurityGroupsResp.SecurityGroups {
+			groupId := aws.ToString(securityGroup.GroupId)
+			if seen[groupId] {
+				continue
+			}
+			seen[groupId] = true
+			name := aws.ToString(securityGroup.GroupName)
+			// unparsable or missing timestamps leave CreatedAt zero
+			createdAt, _ := time.Parse(time.RFC3339, tagValue(securityGroup.Tags, TagCreatedAt))
+			resources = append(resources, cloud.Resource{
+				Kind:      cloud.ResourceSecurityGroup,
+				Id:        groupId,
+				Name:      name,
+				ClusterId: resourceClusterId(securityGroup.Tags, name, meta.SecurityGroupNamePrefix),
+				CreatedAt: createdAt,
+			})
+		}
+	}
+	return resources, nil
+}
+
+// InScope reports whether a cluster was deployed to the region this service lists
+func (awsClient *AwsService) InScope(params map[string]string) bool {
+	region := params[ParamRegion]
+	if region == "" {
+		region = DefaultRegion
+	}
+	return region == awsClient.opts.Region
+}
+
+// resourceClusterId reads the cluster id tag, falling back to the id in the name
+func resourceClusterId(tags []types.Tag, name string, namePrefix string) string {
+	if clusterId := tagValue(tags, TagClusterId); clusterId != "" {
+		return clusterId
+	}
+	return strings.TrimPrefix(name, namePrefix+"-")
+}
@@ -0,0 +1,75 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// operations that change a cluster, only one may run on a cluster at a time
+const (
+	OperationDeploy   = "deploy"
+	OperationTeardown = "teardown"
+	OperationExtend   = "extend"
+	OperationGc       = "gc"
+	OperationMigrate  = "migrate"
+)
+
+// what a cluster is being subjected to during an operation
+var operationParticiples = map[string]string{
+	OperationDeploy:   "deployed",
+	OperationTeardown: "torn down",
+	OperationExtend:   "extended",
+	OperationGc:       "garbage collected",
+	OperationMigrate:  "migrated",
+}
+
+// Lease is held by whoever runs an operation on a cluster, it lapses at ExpiresAt
+// in case the holder dies without releasing it
+type Lease struct {
+	Holder     string    `json:"holder"`
+	Operation  string    `json:"operation"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// NewLease creates a lease for the current operator
+func NewLease(operation string, ttl time.Duration) *Lease {
+	now := time.Now().UTC()
+	return &Lease{
+		Holder:     Operator(),
+		Operation:  operation,
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+}
+
+func LoadLease(bytes []byte) (*Lease, error) {
+	var lease Lease
+	if err := json.Unmarshal(bytes, &lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+func (l *Lease) Bytes() []byte {
+	bytes, err := json.Marshal(l)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to serialize lease: %v", err))
+	}
+	return bytes
+}
+
+// Expired reports whether the lease lapsed by now
+func (l *Lease) Expired(now time.Time) bool {
+	return !now.Before(l.ExpiresAt)
+}
+
+// Describe is e.g. "being torn down by alice@laptop since 10:02"
+func (l *Lease) Describe() string {
+	participle, ok := operationParticiples[l.Operation]
+	if !ok {
+		participle = "changed (" + l.Operation + ")"
+	}
+	return fmt.Sprintf("being %s by %s since %s", participle, l.Holder, l.AcquiredAt.Local().Format("15:04"))
+}
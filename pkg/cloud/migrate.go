@@ -0,0 +1,72 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// AgentClusterSchemaVersion is the schema version of records written by this smithy
+const AgentClusterSchemaVersion = 1
+
+// migration upgrades a record from the schema version it is indexed by to the next
+// one. Records are migrated as raw json so fields can be renamed or restructured
+// without the old layout having to be kept around as a struct.
+type migration func(record map[string]json.RawMessage) error
+
+var migrations = []migration{
+	// 0 -> 1: records without a schema version
+	func(record map[string]json.RawMessage) error {
+		// clusters created before providers were recorded were always deployed to aws
+		if provider, ok := record["provider"]; !ok || string(provider) == `""` {
+			record["provider"] = mustMarshal(DefaultProvider)
+		}
+		// clusters created before statuses were recorded were only stored once running
+		if status, ok := record["status"]; !ok || string(status) == `""` {
+			record["status"] = mustMarshal(StatusRunning)
+		}
+		return nil
+	},
+}
+
+// MigrateAgentCluster upgrades a serialized record to the current schema version,
+// it returns the upgraded record and the version it was upgraded from
+func MigrateAgentCluster(bytes []byte) ([]byte, int, error) {
+	record := map[string]json.RawMessage{}
+	if err := json.Unmarshal(bytes, &record); err != nil {
+		return nil, 0, err
+	}
+
+	version := 0
+	if raw, ok := record["schema_version"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return nil, 0, fmt.Errorf("invalid schema version %s, %v", raw, err)
+		}
+	}
+	if version > AgentClusterSchemaVersion {
+		return nil, version, fmt.Errorf("record has schema version %d, this smithy only understands up to %d, upgrade smithy", version, AgentClusterSchemaVersion)
+	}
+	if version == AgentClusterSchemaVersion {
+		return bytes, version, nil
+	}
+
+	for v := version; v < AgentClusterSchemaVersion; v++ {
+		if err := migrations[v](record); err != nil {
+			return nil, version, fmt.Errorf("unable to migrate record from schema version %d to %d, %v", v, v+1, err)
+		}
+	}
+	record["schema_version"] = mustMarshal(AgentClusterSchemaVersion)
+
+	migrated, err := json.Marshal(record)
+	if err != nil {
+		return nil, version, err
+	}
+	return migrated, version, nil
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to serialize %v: %v", v, err))
+	}
+	return bytes
+}
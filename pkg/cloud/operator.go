@@ -0,0 +1,20 @@
+package cloud
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+)
+
+// Operator identifies who is running smithy, as user@host
+func Operator() string {
+	username := "unknown"
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s@%s", username, hostname)
+}
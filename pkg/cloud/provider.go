@@ -0,0 +1,130 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultProvider is used for clusters that were created before the provider was recorded
+const DefaultProvider = "aws"
+
+type Deployer interface {
+	// CreateComputeInstances returns the instances ordered by node index, the
+	// instance at index i is agent <clusterId>-node-i
+	CreateComputeInstances(ctx context.Context, securityGroupName string, instanceGroupName string, instanceCount int32, credsPath string, clusterId string) ([]ComputeInstance, error)
+	CreateSecurityGroup(ctx context.Context, securityGroupName string, clusterId string) (securityGroupId string, err error)
+}
+
+type Terminator interface {
+	DeleteSecurityGroup(ctx context.Context, securityGroupId string) error
+	TerminateComputeInstances(ctx context.Context, instanceIds []string) error
+}
+
+// Provider is a cloud backend able to both deploy and tear down agent clusters
+type Provider interface {
+	Deployer
+	Terminator
+}
+
+// Discoverer providers can find the resources of a cluster without its record,
+// e.g. by tags, so resources the record doesn't know about are torn down as well
+type Discoverer interface {
+	DiscoverResources(ctx context.Context, clusterId string) (instanceIds []string, securityGroupIds []string, err error)
+}
+
+const (
+	ResourceInstance      = "instance"
+	ResourceSecurityGroup = "security-group"
+)
+
+// Resource is a cloud resource created by smithy
+type Resource struct {
+	// Kind is ResourceInstance or ResourceSecurityGroup
+	Kind      string
+	Id        string
+	Name      string
+	ClusterId string
+	// CreatedAt is zero when the provider can't tell
+	CreatedAt time.Time
+}
+
+// Lister providers can enumerate every resource smithy created with them, across clusters
+type Lister interface {
+	ListResources(ctx context.Context) ([]Resource, error)
+	// InScope reports whether a cluster deployed with the given params is covered
+	// by ListResources, e.g. because it lives in the same region
+	InScope(params map[string]string) bool
+}
+
+// Parameterized providers report their effective settings, defaults included,
+// which are persisted with the cluster in place of the params it was deployed with
+type Parameterized interface {
+	Params() map[string]string
+}
+
+// Validator providers can tell whether a deploy is bound to fail before anything
+// is provisioned, e.g. because a setting it needs is missing
+type Validator interface {
+	ValidateDeploy() error
+}
+
+// Options are passed to a provider when it is created
+type Options struct {
+	// ServerUrl is the url of the command server agents connect to
+	ServerUrl string
+	// Params are provider specific settings, they are persisted with the cluster
+	// so the cluster is torn down with the same settings it was deployed with
+	Params map[string]string
+	// ExecAllow are the programs the agents' exec command may run, none disables it
+	ExecAllow []string
+}
+
+// Factory creates a provider instance
+type Factory func(ctx context.Context, opts Options) (Provider, error)
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]Factory{}
+)
+
+// Register makes a provider available by name, it panics if the name is already taken
+func Register(name string, factory Factory) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	if factory == nil {
+		panic("cloud: Register factory is nil")
+	}
+	if _, dup := providers[name]; dup {
+		panic(fmt.Sprintf("cloud: Register called twice for provider %s", name))
+	}
+	providers[name] = factory
+}
+
+// New creates an instance of the named provider
+func New(ctx context.Context, name string, opts Options) (Provider, error) {
+	providersMu.RLock()
+	factory, ok := providers[name]
+	providersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown cloud provider %q (available: %v)", name, Providers())
+	}
+	return factory(ctx, opts)
+}
+
+// Providers returns the sorted names of all registered providers
+func Providers() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,51 @@
+package cloud
+
+import "time"
+
+// Status is the lifecycle state of a cluster. deploy-agents moves it through
+// provisioning, starting, configuring and running, the server configs are
+// rendered from the addresses of the launched instances so configuring comes last.
+type Status string
+
+const (
+	// the security group is being created
+	StatusProvisioning Status = "provisioning"
+	// the compute instances are being launched and waited for
+	StatusStarting Status = "starting"
+	// the server config is being rendered and stored
+	StatusConfiguring Status = "configuring"
+	// all agents are up
+	StatusRunning Status = "running"
+	// some nodes are unhealthy, set and cleared by status and start-nats -wait
+	StatusDegraded Status = "degraded"
+	// the cluster is being torn down
+	StatusTearingDown Status = "tearing-down"
+	// a deploy or teardown failed half-way, see LastError
+	StatusFailed Status = "failed"
+)
+
+// Transition records when a cluster entered a status
+type Transition struct {
+	Status Status    `json:"status"`
+	At     time.Time `json:"at"`
+}
+
+// SetStatus moves the cluster to a status, a non-nil err is kept as the last error
+func (ac *AgentCluster) SetStatus(status Status, err error) {
+	ac.Status = status
+	ac.Transitions = append(ac.Transitions, Transition{
+		Status: status,
+		At:     time.Now().UTC(),
+	})
+	if err != nil {
+		ac.LastError = err.Error()
+	}
+}
+
+// StatusSince is when the cluster entered its current status, zero if unknown
+func (ac *AgentCluster) StatusSince() time.Time {
+	if len(ac.Transitions) == 0 {
+		return time.Time{}
+	}
+	return ac.Transitions[len(ac.Transitions)-1].At
+}
@@ -3,6 +3,12 @@ package cloud
 import (
 	"encoding/json"
 	"fmt"
+	"time"
+)
+
+const (
+	DefaultClientPort  = 4222
+	DefaultClusterPort = 6222
 )
 
 type ComputeInstance struct {
@@ -10,23 +16,72 @@ type ComputeInstance struct {
 	InstanceId string `json:"instance_id"`
 	PrivateIp  string `json:"private_ip"`
 	PublicIp   string `json:"public_ip"`
+	// optional, only set by providers that know them at deploy time
+	AgentId string `json:"agent_id,omitempty"`
+	Pid     int    `json:"pid,omitempty"`
+	// optional, providers running several nodes on one host assign distinct ports
+	ClientPort  int `json:"client_port,omitempty"`
+	ClusterPort int `json:"cluster_port,omitempty"`
+	MonitorPort int `json:"monitor_port,omitempty"`
+}
+
+// ClientUrl is the url clients use to connect to the node's nats-server
+func (ci *ComputeInstance) ClientUrl() string {
+	port := ci.ClientPort
+	if port == 0 {
+		port = DefaultClientPort
+	}
+	return fmt.Sprintf("nats://%s:%d", ci.DnsName, port)
+}
+
+// RouteUrl is the url other nodes use to route to the node's nats-server
+func (ci *ComputeInstance) RouteUrl() string {
+	port := ci.ClusterPort
+	if port == 0 {
+		port = DefaultClusterPort
+	}
+	return fmt.Sprintf("nats://%s:%d", ci.DnsName, port)
 }
 
 type AgentCluster struct {
+	// SchemaVersion is the layout of the stored record, see migrations
+	SchemaVersion     int               `json:"schema_version"`
+	Provider          string            `json:"provider"`
+	ProviderParams    map[string]string `json:"provider_params,omitempty"`
 	SecurityGroupName string            `json:"security_group_name"`
 	SecurityGroupId   string            `json:"security_group_id"`
 	ComputeInstances  []ComputeInstance `json:"compute_instances"`
+	// ExecAllow are the programs the agents' exec command may run
+	ExecAllow []string `json:"exec_allow,omitempty"`
+	// ExpiresAt is when the reaper tears the cluster down, nil keeps it forever
+	ExpiresAt   *time.Time   `json:"expires_at,omitempty"`
+	Status      Status       `json:"status,omitempty"`
+	Transitions []Transition `json:"transitions,omitempty"`
+	LastError   string       `json:"last_error,omitempty"`
+}
+
+// Expired reports whether the cluster has a ttl that ran out by now
+func (ac *AgentCluster) Expired(now time.Time) bool {
+	return ac.ExpiresAt != nil && !now.Before(*ac.ExpiresAt)
 }
 
+// LoadAgentCluster reads a record of any schema version up to the current one,
+// older records are migrated
 func LoadAgentCluster(bytes []byte) (*AgentCluster, error) {
+	migrated, _, err := MigrateAgentCluster(bytes)
+	if err != nil {
+		return nil, err
+	}
 	var ac AgentCluster
-	if err := json.Unmarshal(bytes, &ac); err != nil {
+	if err := json.Unmarshal(migrated, &ac); err != nil {
 		return nil, err
 	}
 	return &ac, nil
 }
 
+// Bytes serializes the record in the current schema version
 func (ac *AgentCluster) Bytes() []byte {
+	ac.SchemaVersion = AgentClusterSchemaVersion
 	bytes, err := json.Marshal(ac)
 	if err != nil {
 		panic(fmt.Sprintf("Failed to serialize agent-cluster metadata: %v", err))
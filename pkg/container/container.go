@@ -0,0 +1,394 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"smithy/pkg/cloud"
+	"strings"
+	"time"
+)
+
+const (
+	ProviderName = "container"
+
+	// nats-server is on the PATH of the official image, smithy is mounted into it
+	defaultImage = "nats:2.10-alpine"
+
+	containerBinaryPath = "/usr/local/bin/smithy"
+	containerCredsPath  = "/etc/smithy/agent.creds"
+
+	// label put on every network and container so smithy resources can be found
+	clusterLabel = "smithy.cluster-id"
+
+	// how long freshly started agent containers have to keep running to be considered started
+	startGracePeriod = 2 * time.Second
+)
+
+func init() {
+	cloud.Register(ProviderName, func(ctx context.Context, opts cloud.Options) (cloud.Provider, error) {
+		return New(opts.ServerUrl, opts.Params, opts.ExecAllow)
+	})
+}
+
+// ContainerService runs every agent in its own container on a local docker or
+// podman engine. The security group analogue is a user-defined bridge network
+// and instance ids are container ids.
+//
+// Supported params:
+//
+//	engine  container engine binary, docker or podman (default: whichever is installed)
+//	image   image providing nats-server (default nats:2.10-alpine)
+//	binary  linux smithy binary mounted into the containers (default: this executable),
+//	        it must be statically linked, e.g. built with CGO_ENABLED=0
+type ContainerService struct {
+	engine    string
+	image     string
+	binary    string
+	serverUrl string
+	execAllow []string
+}
+
+func New(serverUrl string, params map[string]string, execAllow []string) (*ContainerService, error) {
+	engine := params["engine"]
+	if engine == "" {
+		for _, candidate := range []string{"docker", "podman"} {
+			if _, err := exec.LookPath(candidate); err == nil {
+				engine = candidate
+				break
+			}
+		}
+		if engine == "" {
+			return nil, fmt.Errorf("no container engine found, install docker or podman")
+		}
+	}
+
+	image := params["image"]
+	if image == "" {
+		image = defaultImage
+	}
+
+	binary := params["binary"]
+	if binary == "" {
+		executable, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("unable to locate smithy executable, %v", err)
+		}
+		binary = executable
+	}
+	binary, err := filepath.Abs(binary)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve smithy binary, %v", err)
+	}
+
+	return &ContainerService{
+		engine:    engine,
+		image:     image,
+		binary:    binary,
+		serverUrl: serverUrl,
+		execAllow: execAllow,
+	}, nil
+}
+
+// Params returns the effective settings, so teardown uses the engine the cluster was deployed with
+func (containerClient *ContainerService) Params() map[string]string {
+	return map[string]string{
+		"engine": containerClient.engine,
+		"image":  containerClient.image,
+		"binary": containerClient.binary,
+	}
+}
+
+// run executes an engine command and returns its trimmed stdout
+func (containerClient *ContainerService) run(ctx context.Context, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, containerClient.engine, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s %s failed: %v: %s", containerClient.engine, args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (containerClient *ContainerService) CreateSecurityGroup(ctx context.Context, securityGroupName string, clusterId string) (securityGroupId string, err error) {
+	securityGroupId, err = containerClient.run(ctx,
+		"network", "create",
+		"--driver", "bridge",
+		"--label", fmt.Sprintf("%s=%s", clusterLabel, clusterId),
+		securityGroupName,
+	)
+	if err != nil {
+		return "", fmt.Errorf("unable to create network, %v", err)
+	}
+	return securityGroupId, nil
+}
+
+func (containerClient *ContainerService) DeleteSecurityGroup(ctx context.Context, securityGroupId string) error {
+	if _, err := containerClient.run(ctx, "network", "rm", securityGroupId); err != nil {
+		return fmt.Errorf("unable to delete network, %v", err)
+	}
+	return nil
+}
+
+func (containerClient *ContainerService) CreateComputeInstances(ctx context.Context, securityGroupName string, instanceTagName string, instanceCount int32, credsPath string, clusterId string) ([]cloud.ComputeInstance, error) {
+
+	serverUrl, hostArgs, err := containerClient.containerServerUrl()
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := []string{"-v", fmt.Sprintf("%s:%s:ro", containerClient.binary, containerBinaryPath)}
+	if credsPath != "" {
+		absCredsPath, err := filepath.Abs(credsPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve creds file, %v", err)
+		}
+		mounts = append(mounts, "-v", fmt.Sprintf("%s:%s:ro", absCredsPath, containerCredsPath))
+	}
+
+	containerIds := []string{}
+	// don't leave the containers started so far running
+	rollback := func(err error) ([]cloud.ComputeInstance, error) {
+		if len(containerIds) > 0 {
+			if removeErr := containerClient.TerminateComputeInstances(context.WithoutCancel(ctx), containerIds); removeErr != nil {
+				log.Printf("unable to clean up containers: %v", removeErr)
+			}
+		}
+		return nil, err
+	}
+
+	for nodeIndex := 0; nodeIndex < int(instanceCount); nodeIndex++ {
+		agentId := fmt.Sprintf("%s-node-%d", clusterId, nodeIndex)
+
+		args := []string{
+			"run", "--detach",
+			"--name", agentId,
+			"--hostname", agentId,
+			"--network", securityGroupName,
+			"--label", fmt.Sprintf("%s=%s", clusterLabel, clusterId),
+			"--label", fmt.Sprintf("smithy.name=%s", instanceTagName),
+			"--entrypoint", containerBinaryPath,
+		}
+		args = append(args, hostArgs...)
+		args = append(args, mounts...)
+		args = append(args, containerClient.image,
+			"start-agent",
+			"-server", serverUrl,
+			"-cluster", clusterId,
+			"-id", agentId,
+		)
+		if credsPath != "" {
+			args = append(args, "-creds", containerCredsPath)
+		}
+		if len(containerClient.execAllow) > 0 {
+			args = append(args, "-exec-allow", strings.Join(containerClient.execAllow, ","))
+		}
+
+		containerId, err := containerClient.run(ctx, args...)
+		if err != nil {
+			return rollback(fmt.Errorf("unable to run agent container %s, %v", agentId, err))
+		}
+		containerIds = append(containerIds, containerId)
+	}
+
+	// agents that can't reach the command server exit right away
+	select {
+	case <-ctx.Done():
+		return rollback(ctx.Err())
+	case <-time.After(startGracePeriod):
+	}
+
+	containers, err := containerClient.inspectContainers(ctx, containerIds)
+	if err != nil {
+		return rollback(err)
+	}
+	computeInstances := []cloud.ComputeInstance{}
+	for nodeIndex, containerId := range containerIds {
+		agentId := fmt.Sprintf("%s-node-%d", clusterId, nodeIndex)
+		info, ok := containers[containerId]
+		if !ok {
+			return rollback(fmt.Errorf("agent container %s is gone", agentId))
+		}
+		if !info.State.Running {
+			logs, _ := exec.CommandContext(ctx, containerClient.engine, "logs", "--tail", "20", containerId).CombinedOutput()
+			return rollback(fmt.Errorf("agent container %s exited during startup with code %d: %s", agentId, info.State.ExitCode, strings.TrimSpace(string(logs))))
+		}
+
+		// container ips are reachable from the host and from the other containers,
+		// the container name only resolves within the network
+		ipAddress := info.NetworkSettings.Networks[securityGroupName].IPAddress
+		computeInstances = append(computeInstances, cloud.ComputeInstance{
+			DnsName:    ipAddress,
+			InstanceId: containerId,
+			PrivateIp:  ipAddress,
+			PublicIp:   ipAddress,
+			AgentId:    agentId,
+		})
+	}
+	return computeInstances, nil
+}
+
+// containerServerUrl rewrites a command server url pointing at this machine so it
+// is reachable from within the containers
+func (containerClient *ContainerService) containerServerUrl() (string, []string, error) {
+	serverUrl, err := url.Parse(containerClient.serverUrl)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid server url %s, %v", containerClient.serverUrl, err)
+	}
+
+	switch serverUrl.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+	default:
+		return containerClient.serverUrl, nil, nil
+	}
+
+	// podman adds host.containers.internal by itself, docker needs to be told
+	hostName := "host.containers.internal"
+	hostArgs := []string{}
+	if filepath.Base(containerClient.engine) != "podman" {
+		hostName = "host.docker.internal"
+		hostArgs = append(hostArgs, "--add-host", hostName+":host-gateway")
+	}
+	if port := serverUrl.Port(); port != "" {
+		serverUrl.Host = fmt.Sprintf("%s:%s", hostName, port)
+	} else {
+		serverUrl.Host = hostName
+	}
+	return serverUrl.String(), hostArgs, nil
+}
+
+// DiscoverResources finds the containers and networks of a cluster by their labels
+func (containerClient *ContainerService) DiscoverResources(ctx context.Context, clusterId string) (instanceIds []string, securityGroupIds []string, err error) {
+	labelFilter := fmt.Sprintf("label=%s=%s", clusterLabel, clusterId)
+
+	containers, err := containerClient.run(ctx, "ps", "--all", "--quiet", "--no-trunc", "--filter", labelFilter)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to list containers, %v", err)
+	}
+	networks, err := containerClient.run(ctx, "network", "ls", "--quiet", "--no-trunc", "--filter", labelFilter)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to list networks, %v", err)
+	}
+	return strings.Fields(containers), strings.Fields(networks), nil
+}
+
+// ListResources finds the containers and networks of every smithy cluster on the engine
+func (containerClient *ContainerService) ListResources(ctx context.Context) ([]cloud.Resource, error) {
+	labelFilter := "label=" + clusterLabel
+
+	containerIds, err := containerClient.run(ctx, "ps", "--all", "--quiet", "--no-trunc", "--filter", labelFilter)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list containers, %v", err)
+	}
+	networkIds, err := containerClient.run(ctx, "network", "ls", "--quiet", "--no-trunc", "--filter", labelFilter)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list networks, %v", err)
+	}
+
+	resources := []cloud.Resource{}
+	containers, err := containerClient.inspectContainers(ctx, strings.Fields(containerIds))
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range containers {
+		resources = append(resources, cloud.Resource{
+			Kind:      cloud.ResourceInstance,
+			Id:        info.Id,
+			Name:      strings.TrimPrefix(info.Name, "/"),
+			ClusterId: info.Config.Labels[clusterLabel],
+			CreatedAt: info.Created,
+		})
+	}
+	networks := []networkInfo{}
+	if ids := strings.Fields(networkIds); len(ids) > 0 {
+		if err = containerClient.inspect(ctx, &networks, append([]string{"network", "inspect"}, ids...)...); err != nil {
+			return nil, fmt.Errorf("unable to inspect networks, %v", err)
+		}
+	}
+	for _, info := range networks {
+		resources = append(resources, cloud.Resource{
+			Kind:      cloud.ResourceSecurityGroup,
+			Id:        info.Id,
+			Name:      info.Name,
+			ClusterId: info.Labels[clusterLabel],
+			CreatedAt: info.Created,
+		})
+	}
+	return resources, nil
+}
+
+// containerInfo and networkInfo are the parts of the inspect output docker and
+// podman agree on, podman's lower case keys match them as well
+type (
+	containerInfo struct {
+		Id      string
+		Name    string
+		Created time.Time
+		State   struct {
+			Running  bool
+			ExitCode int
+		}
+		Config struct {
+			Labels map[string]string
+		}
+		NetworkSettings struct {
+			Networks map[string]struct {
+				IPAddress string
+			}
+		}
+	}
+	networkInfo struct {
+		Id      string
+		Name    string
+		Created time.Time
+		Labels  map[string]string
+	}
+)
+
+// inspect runs an inspect command and decodes its json output into v
+func (containerClient *ContainerService) inspect(ctx context.Context, v interface{}, args ...string) error {
+	out, err := containerClient.run(ctx, args...)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal([]byte(out), v); err != nil {
+		return fmt.Errorf("unable to parse %s %s output, %v", containerClient.engine, strings.Join(args[:2], " "), err)
+	}
+	return nil
+}
+
+// inspectContainers describes containers by id
+func (containerClient *ContainerService) inspectContainers(ctx context.Context, containerIds []string) (map[string]containerInfo, error) {
+	containers := map[string]containerInfo{}
+	if len(containerIds) == 0 {
+		return containers, nil
+	}
+	infos := []containerInfo{}
+	if err := containerClient.inspect(ctx, &infos, append([]string{"container", "inspect"}, containerIds...)...); err != nil {
+		return nil, fmt.Errorf("unable to inspect containers, %v", err)
+	}
+	for _, info := range infos {
+		containers[info.Id] = info
+	}
+	return containers, nil
+}
+
+// InScope reports whether a cluster was deployed with the engine this service lists
+func (containerClient *ContainerService) InScope(params map[string]string) bool {
+	return params["engine"] == "" || filepath.Base(params["engine"]) == filepath.Base(containerClient.engine)
+}
+
+func (containerClient *ContainerService) TerminateComputeInstances(ctx context.Context, instanceIds []string) error {
+	args := append([]string{"rm", "--force"}, instanceIds...)
+	if _, err := containerClient.run(ctx, args...); err != nil {
+		return fmt.Errorf("unable to remove containers, %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package container_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"smithy/pkg/cloud"
+	"smithy/pkg/container"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the test binary is the container engine when this names its state file
+const fakeEngineEnv = "SMITHY_FAKE_ENGINE"
+
+func TestMain(m *testing.M) {
+	if statePath := os.Getenv(fakeEngineEnv); statePath != "" {
+		os.Exit(fakeEngine(statePath, os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// engineState is what the fake engine keeps between invocations
+type engineState struct {
+	NextId     int
+	Containers []*fakeContainer
+	Networks   []*fakeNetwork
+	// ExitNames are containers that exit right after they started
+	ExitNames []string
+}
+
+type fakeContainer struct {
+	Id      string
+	Name    string
+	Network string
+	Labels  map[string]string
+	Command []string
+	Running bool
+}
+
+type fakeNetwork struct {
+	Id     string
+	Name   string
+	Labels map[string]string
+}
+
+func loadState(t *testing.T, statePath string) *engineState {
+	t.Helper()
+	state := &engineState{}
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(data, state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func saveState(statePath string, state *engineState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(statePath, data, 0644)
+}
+
+// matchesFilter applies the `label=<key>[=<value>]` filters of ps and network ls
+func matchesFilter(labels map[string]string, filter string) bool {
+	key, value, hasValue := strings.Cut(strings.TrimPrefix(filter, "label="), "=")
+	actual, ok := labels[key]
+	return ok && (!hasValue || actual == value)
+}
+
+// fakeEngine answers the docker commands the provider runs, in docker's formats
+func fakeEngine(statePath string, args []string) int {
+	state := &engineState{}
+	if data, err := os.ReadFile(statePath); err == nil {
+		if err = json.Unmarshal(data, state); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	created := time.Date(2023, 12, 18, 10, 2, 3, 0, time.UTC)
+
+	command := strings.Join(args[:min(2, len(args))], " ")
+	switch {
+	case command == "network create":
+		network := &fakeNetwork{Name: args[len(args)-1], Labels: map[string]string{}}
+		for i := 2; i < len(args)-1; i++ {
+			if args[i] == "--label" {
+				key, value, _ := strings.Cut(args[i+1], "=")
+				network.Labels[key] = value
+			}
+		}
+		state.NextId++
+		network.Id = fmt.Sprintf("network%d", state.NextId)
+		state.Networks = append(state.Networks, network)
+		fmt.Println(network.Id)
+	case command == "network rm":
+		networks := []*fakeNetwork{}
+		for _, network := range state.Networks {
+			if network.Id != args[2] {
+				networks = append(networks, network)
+			}
+		}
+		state.Networks = networks
+	case command == "network ls":
+		for _, network := range state.Networks {
+			if matchesFilter(network.Labels, args[len(args)-1]) {
+				fmt.Println(network.Id)
+			}
+		}
+	case command == "network inspect":
+		infos := []map[string]interface{}{}
+		for _, id := range args[2:] {
+			for _, network := range state.Networks {
+				if network.Id == id {
+					infos = append(infos, map[string]interface{}{"Name": network.Name, "Id": network.Id, "Created": created, "Labels": network.Labels})
+				}
+			}
+		}
+		json.NewEncoder(os.Stdout).Encode(infos)
+	case args[0] == "run":
+		c := &fakeContainer{Labels: map[string]string{}, Running: true}
+		i := 2
+		for ; i < len(args) && strings.HasPrefix(args[i], "-"); i += 2 {
+			switch args[i] {
+			case "--name":
+				c.Name = args[i+1]
+			case "--network":
+				c.Network = args[i+1]
+			case "--label":
+				key, value, _ := strings.Cut(args[i+1], "=")
+				c.Labels[key] = value
+			}
+		}
+		// the image, then the command
+		c.Command = args[i+1:]
+		for _, name := range state.ExitNames {
+			if name == c.Name {
+				c.Running = false
+			}
+		}
+		state.NextId++
+		c.Id = fmt.Sprintf("container%d", state.NextId)
+		state.Containers = append(state.Containers, c)
+		fmt.Println(c.Id)
+	case command == "container inspect":
+		infos := []map[string]interface{}{}
+		for _, id := range args[2:] {
+			for i, c := range state.Containers {
+				if c.Id != id {
+					continue
+				}
+				exitCode := 0
+				if !c.Running {
+					exitCode = 1
+				}
+				infos = append(infos, map[string]interface{}{
+					"Id":      c.Id,
+					"Name":    "/" + c.Name,
+					"Created": created,
+					"State":   map[string]interface{}{"Running": c.Running, "ExitCode": exitCode},
+					"Config":  map[string]interface{}{"Labels": c.Labels},
+					"NetworkSettings": map[string]interface{}{
+						"Networks": map[string]interface{}{c.Network: map[string]string{"IPAddress": fmt.Sprintf("172.18.0.%d", i+2)}},
+					},
+				})
+			}
+		}
+		json.NewEncoder(os.Stdout).Encode(infos)
+	case args[0] == "ps":
+		for _, c := range state.Containers {
+			if matchesFilter(c.Labels, args[len(args)-1]) {
+				fmt.Println(c.Id)
+			}
+		}
+	case args[0] == "rm":
+		containers := []*fakeContainer{}
+		for _, c := range state.Containers {
+			removed := false
+			for _, id := range args[2:] {
+				removed = removed || c.Id == id
+			}
+			if !removed {
+				containers = append(containers, c)
+			}
+		}
+		state.Containers = containers
+	case args[0] == "logs":
+		fmt.Fprintln(os.Stderr, "unable to connect to the command server")
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s\n", command)
+		return 1
+	}
+
+	if err := saveState(statePath, state); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// newService returns a provider using the fake engine and the path of its state,
+// the containers named by exitNames exit right after they started
+func newService(t *testing.T, serverUrl string, execAllow []string, exitNames ...string) (*container.ContainerService, string) {
+	t.Helper()
+	statePath := filepath.Join(t.TempDir(), "engine.json")
+	if err := saveState(statePath, &engineState{ExitNames: exitNames}); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(fakeEngineEnv, statePath)
+	engine, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := container.New(serverUrl, map[string]string{"engine": engine, "binary": engine}, execAllow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc, statePath
+}
+
+func TestCreateComputeInstances(t *testing.T) {
+	ctx := context.Background()
+	svc, statePath := newService(t, "nats://127.0.0.1:4222", []string{"df", "ss"})
+
+	securityGroupId, err := svc.CreateSecurityGroup(ctx, "smithy-sg-a", "a")
+	if err != nil {
+		t.Fatalf("CreateSecurityGroup: %v", err)
+	}
+	instances, err := svc.CreateComputeInstances(ctx, "smithy-sg-a", "smithy-compute-node-a", 2, "", "a")
+	if err != nil {
+		t.Fatalf("CreateComputeInstances: %v", err)
+	}
+	if len(instances) != 2 {
+		t.Fatalf("expected 2 compute instances, got %d", len(instances))
+	}
+	for nodeIndex, ci := range instances {
+		if ci.AgentId != fmt.Sprintf("a-node-%d", nodeIndex) || ci.InstanceId == "" || !strings.HasPrefix(ci.DnsName, "172.18.0.") || ci.PrivateIp != ci.DnsName {
+			t.Errorf("unexpected compute instance %+v", ci)
+		}
+	}
+
+	state := loadState(t, statePath)
+	for _, c := range state.Containers {
+		if c.Network != "smithy-sg-a" || c.Labels["smithy.cluster-id"] != "a" {
+			t.Errorf("container %s isn't in the cluster's network: %+v", c.Name, c)
+		}
+		// the command server on this machine is reached through the engine's host name
+		command := strings.Join(c.Command, " ")
+		if !strings.Contains(command, "start-agent -server nats://host.docker.internal:4222 -cluster a -id "+c.Name) || !strings.HasSuffix(command, "-exec-allow df,ss") {
+			t.Errorf("unexpected agent command %s", command)
+		}
+	}
+
+	if err = svc.TerminateComputeInstances(ctx, []string{instances[0].InstanceId, instances[1].InstanceId}); err != nil {
+		t.Fatalf("TerminateComputeInstances: %v", err)
+	}
+	if err = svc.DeleteSecurityGroup(ctx, securityGroupId); err != nil {
+		t.Fatalf("DeleteSecurityGroup: %v", err)
+	}
+	if state = loadState(t, statePath); len(state.Containers) != 0 || len(state.Networks) != 0 {
+		t.Errorf("expected no containers and networks, got %+v", state)
+	}
+}
+
+func TestCreateComputeInstancesExited(t *testing.T) {
+	ctx := context.Background()
+	svc, statePath := newService(t, "nats://demo.nats.io:4222", nil, "a-node-1")
+
+	if _, err := svc.CreateSecurityGroup(ctx, "smithy-sg-a", "a"); err != nil {
+		t.Fatalf("CreateSecurityGroup: %v", err)
+	}
+	_, err := svc.CreateComputeInstances(ctx, "smithy-sg-a", "smithy-compute-node-a", 2, "", "a")
+	if err == nil || !strings.Contains(err.Error(), "a-node-1 exited during startup") || !strings.Contains(err.Error(), "unable to connect") {
+		t.Fatalf("expected the exited agent to fail the deploy, got %v", err)
+	}
+	// the agent that did start is removed as well
+	if state := loadState(t, statePath); len(state.Containers) != 0 {
+		t.Errorf("expected the containers to be removed, got %+v", state.Containers)
+	}
+}
+
+func TestListResources(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newService(t, "nats://demo.nats.io:4222", nil)
+
+	for _, clusterId := range []string{"a", "b"} {
+		securityGroupName := "smithy-sg-" + clusterId
+		if _, err := svc.CreateSecurityGroup(ctx, securityGroupName, clusterId); err != nil {
+			t.Fatalf("CreateSecurityGroup: %v", err)
+		}
+		if _, err := svc.CreateComputeInstances(ctx, securityGroupName, "smithy-compute-node-"+clusterId, 1, "", clusterId); err != nil {
+			t.Fatalf("CreateComputeInstances: %v", err)
+		}
+	}
+
+	resources, err := svc.ListResources(ctx)
+	if err != nil {
+		t.Fatalf("ListResources: %v", err)
+	}
+	names := map[string]cloud.Resource{}
+	for _, resource := range resources {
+		names[resource.Name] = resource
+		if resource.CreatedAt.IsZero() {
+			t.Errorf("%s %s has no creation time", resource.Kind, resource.Name)
+		}
+	}
+	for name, expected := range map[string]cloud.Resource{
+		"a-node-0":    {Kind: cloud.ResourceInstance, ClusterId: "a"},
+		"b-node-0":    {Kind: cloud.ResourceInstance, ClusterId: "b"},
+		"smithy-sg-a": {Kind: cloud.ResourceSecurityGroup, ClusterId: "a"},
+		"smithy-sg-b": {Kind: cloud.ResourceSecurityGroup, ClusterId: "b"},
+	} {
+		resource, ok := names[name]
+		if !ok || resource.Kind != expected.Kind || resource.ClusterId != expected.ClusterId {
+			t.Errorf("expected %s %s of cluster %s, got %+v", expected.Kind, name, expected.ClusterId, resource)
+		}
+	}
+
+	instanceIds, securityGroupIds, err := svc.DiscoverResources(ctx, "a")
+	if err != nil {
+		t.Fatalf("DiscoverResources: %v", err)
+	}
+	if len(instanceIds) != 1 || instanceIds[0] != names["a-node-0"].Id || len(securityGroupIds) != 1 || securityGroupIds[0] != names["smithy-sg-a"].Id {
+		t.Errorf("unexpected resources of cluster a: %v %v", instanceIds, securityGroupIds)
+	}
+}
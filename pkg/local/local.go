@@ -0,0 +1,364 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"smithy/internal/meta"
+	"smithy/pkg/cloud"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	ProviderName = "local"
+
+	// how long a freshly spawned agent has to stay up to be considered started
+	startGracePeriod = 500 * time.Millisecond
+	// how long an agent gets to shut down before it is killed
+	stopGracePeriod = 10 * time.Second
+
+	// written to the node directory so agents can be found without a cluster record
+	pidFileName = "agent.pid"
+)
+
+func init() {
+	cloud.Register(ProviderName, func(ctx context.Context, opts cloud.Options) (cloud.Provider, error) {
+		return New(opts.ServerUrl, opts.ExecAllow)
+	})
+}
+
+// LocalService runs every agent as a `smithy start-agent` child process on this
+// machine. The security group analogue is a working directory holding one
+// sub-directory per node, and instance ids are the agent process ids.
+type LocalService struct {
+	serverUrl  string
+	execAllow  []string
+	executable string
+	baseDir    string
+}
+
+func New(serverUrl string, execAllow []string) (*LocalService, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("unable to locate smithy executable, %v", err)
+	}
+	return &LocalService{
+		serverUrl:  serverUrl,
+		execAllow:  execAllow,
+		executable: executable,
+		baseDir:    filepath.Join(os.TempDir(), "smithy"),
+	}, nil
+}
+
+func (localClient *LocalService) clusterDir(securityGroupName string) string {
+	return filepath.Join(localClient.baseDir, securityGroupName)
+}
+
+func (localClient *LocalService) CreateSecurityGroup(ctx context.Context, securityGroupName string, clusterId string) (securityGroupId string, err error) {
+	dir := localClient.clusterDir(securityGroupName)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("unable to create cluster directory, %v", err)
+	}
+	return dir, nil
+}
+
+func (localClient *LocalService) DeleteSecurityGroup(ctx context.Context, securityGroupId string) error {
+	// only ever remove directories this provider created
+	if filepath.Dir(securityGroupId) != localClient.baseDir {
+		return fmt.Errorf("refusing to delete %s, not a smithy cluster directory", securityGroupId)
+	}
+	if err := os.RemoveAll(securityGroupId); err != nil {
+		return fmt.Errorf("unable to delete cluster directory, %v", err)
+	}
+	return nil
+}
+
+func (localClient *LocalService) CreateComputeInstances(ctx context.Context, securityGroupName string, instanceTagName string, instanceCount int32, credsPath string, clusterId string) ([]cloud.ComputeInstance, error) {
+
+	if credsPath != "" {
+		absCredsPath, err := filepath.Abs(credsPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve creds file, %v", err)
+		}
+		credsPath = absCredsPath
+	}
+
+	computeInstances := []cloud.ComputeInstance{}
+	for nodeIndex := 0; nodeIndex < int(instanceCount); nodeIndex++ {
+		computeInstance, err := localClient.startAgent(ctx, securityGroupName, credsPath, clusterId, nodeIndex)
+		if err != nil {
+			// don't leave the agents started so far running
+			instanceIds := []string{}
+			for _, ci := range computeInstances {
+				instanceIds = append(instanceIds, ci.InstanceId)
+			}
+			if terminateErr := localClient.TerminateComputeInstances(context.WithoutCancel(ctx), instanceIds); terminateErr != nil {
+				log.Printf("unable to clean up agents: %v", terminateErr)
+			}
+			return nil, err
+		}
+		computeInstances = append(computeInstances, *computeInstance)
+	}
+	return computeInstances, nil
+}
+
+func (localClient *LocalService) startAgent(ctx context.Context, securityGroupName string, credsPath string, clusterId string, nodeIndex int) (*cloud.ComputeInstance, error) {
+
+	agentId := fmt.Sprintf("%s-node-%d", clusterId, nodeIndex)
+	nodeDir := filepath.Join(localClient.clusterDir(securityGroupName), agentId)
+	if err := os.MkdirAll(nodeDir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create node directory, %v", err)
+	}
+
+	clientPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	clusterPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	monitorPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+
+	logFile, err := os.Create(filepath.Join(nodeDir, "smithy.log"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create agent log file, %v", err)
+	}
+	defer logFile.Close()
+
+	args := []string{
+		"start-agent",
+		"-server", localClient.serverUrl,
+		"-cluster", clusterId,
+		"-id", agentId,
+		"-workdir", nodeDir,
+		"-client-port", strconv.Itoa(clientPort),
+		"-cluster-port", strconv.Itoa(clusterPort),
+		"-monitor-port", strconv.Itoa(monitorPort),
+	}
+	if credsPath != "" {
+		args = append(args, "-creds", credsPath)
+	}
+	if len(localClient.execAllow) > 0 {
+		args = append(args, "-exec-allow", strings.Join(localClient.execAllow, ","))
+	}
+
+	// not tied to ctx, the agent has to outlive the deploy command
+	cmd := exec.Command(localClient.executable, args...)
+	cmd.Dir = nodeDir
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// in a process group of its own, Ctrl-C in the deploy command's terminal
+	// must not reach it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to start agent %s, %v", agentId, err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	// agents that can't reach the command server exit right away
+	select {
+	case err = <-exited:
+		return nil, fmt.Errorf("agent %s exited during startup (%v), see %s", agentId, err, logFile.Name())
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		return nil, ctx.Err()
+	case <-time.After(startGracePeriod):
+	}
+
+	pid := strconv.Itoa(cmd.Process.Pid)
+	if err = os.WriteFile(filepath.Join(nodeDir, pidFileName), []byte(pid), 0644); err != nil {
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("unable to write pid file of agent %s, %v", agentId, err)
+	}
+
+	return &cloud.ComputeInstance{
+		DnsName:     "localhost",
+		InstanceId:  pid,
+		PrivateIp:   "127.0.0.1",
+		PublicIp:    "127.0.0.1",
+		AgentId:     agentId,
+		Pid:         cmd.Process.Pid,
+		ClientPort:  clientPort,
+		ClusterPort: clusterPort,
+		MonitorPort: monitorPort,
+	}, nil
+}
+
+func (localClient *LocalService) TerminateComputeInstances(ctx context.Context, instanceIds []string) error {
+	processes := []*os.Process{}
+	for _, instanceId := range instanceIds {
+		pid, err := strconv.Atoi(instanceId)
+		if err != nil {
+			return fmt.Errorf("invalid local instance id %s, %v", instanceId, err)
+		}
+		// the pid may have been reused since, e.g. after a reboot, never signal
+		// a process that isn't one of our agents
+		if _, ok := localClient.agentProcess(pid); !ok {
+			log.Printf("process %d is not a smithy agent, assuming the agent already exited", pid)
+			continue
+		}
+		process, err := os.FindProcess(pid)
+		if err != nil {
+			return fmt.Errorf("unable to find agent process %d, %v", pid, err)
+		}
+		// the agent stops its nats-server on SIGTERM, already exited agents are fine
+		if err = process.Signal(syscall.SIGTERM); err != nil && !isFinished(err) {
+			return fmt.Errorf("unable to stop agent process %d, %v", pid, err)
+		}
+		processes = append(processes, process)
+	}
+
+	// wait for agents to exit, killing any that take too long
+	deadline := time.Now().Add(stopGracePeriod)
+	for _, process := range processes {
+		for process.Signal(syscall.Signal(0)) == nil {
+			if time.Now().After(deadline) {
+				log.Printf("agent process %d did not stop, killing it", process.Pid)
+				process.Kill()
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("failed to wait for agents to stop, %v", ctx.Err())
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+	return nil
+}
+
+// ListResources finds the cluster directories and the agents still running in them
+func (localClient *LocalService) ListResources(ctx context.Context) ([]cloud.Resource, error) {
+	resources := []cloud.Resource{}
+	clusterDirs, err := os.ReadDir(localClient.baseDir)
+	if os.IsNotExist(err) {
+		return resources, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to list cluster directories, %v", err)
+	}
+
+	for _, clusterDir := range clusterDirs {
+		if !clusterDir.IsDir() || !strings.HasPrefix(clusterDir.Name(), meta.SecurityGroupNamePrefix+"-") {
+			continue
+		}
+		clusterId := strings.TrimPrefix(clusterDir.Name(), meta.SecurityGroupNamePrefix+"-")
+		dir := localClient.clusterDir(clusterDir.Name())
+		resource := cloud.Resource{
+			Kind:      cloud.ResourceSecurityGroup,
+			Id:        dir,
+			Name:      clusterDir.Name(),
+			ClusterId: clusterId,
+		}
+		if info, err := clusterDir.Info(); err == nil {
+			resource.CreatedAt = info.ModTime()
+		}
+		resources = append(resources, resource)
+
+		pidFiles, err := filepath.Glob(filepath.Join(dir, "*", pidFileName))
+		if err != nil {
+			return nil, fmt.Errorf("unable to list agents, %v", err)
+		}
+		for _, pidFile := range pidFiles {
+			contents, err := os.ReadFile(pidFile)
+			if err != nil {
+				continue
+			}
+			pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+			if err != nil {
+				continue
+			}
+			// a leftover pid file may name a process that reused the pid
+			agentId := filepath.Base(filepath.Dir(pidFile))
+			if id, ok := localClient.agentProcess(pid); !ok || id != agentId {
+				continue
+			}
+			resource := cloud.Resource{
+				Kind:      cloud.ResourceInstance,
+				Id:        strconv.Itoa(pid),
+				Name:      agentId,
+				ClusterId: clusterId,
+			}
+			if info, err := os.Stat(pidFile); err == nil {
+				resource.CreatedAt = info.ModTime()
+			}
+			resources = append(resources, resource)
+		}
+	}
+	return resources, nil
+}
+
+// InScope is always true, every local cluster lives in the same base directory
+func (localClient *LocalService) InScope(params map[string]string) bool {
+	return true
+}
+
+// agentProcess returns the id of the agent running as process pid, ok is false
+// unless pid is a `smithy start-agent` this provider started
+func (localClient *LocalService) agentProcess(pid int) (agentId string, ok bool) {
+	args, err := processArgs(pid)
+	if err != nil || len(args) < 2 || args[1] != "start-agent" {
+		return "", false
+	}
+	workDir := ""
+	for i := 2; i < len(args)-1; i++ {
+		switch args[i] {
+		case "-id":
+			agentId = args[i+1]
+		case "-workdir":
+			workDir = args[i+1]
+		}
+	}
+	// agents run in <base dir>/<cluster dir>/<agent id>
+	if agentId == "" || filepath.Dir(filepath.Dir(workDir)) != localClient.baseDir {
+		return "", false
+	}
+	return agentId, true
+}
+
+// processArgs returns the command line of a running process
+func processArgs(pid int) ([]string, error) {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err == nil {
+		return strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"), nil
+	}
+	if _, statErr := os.Stat("/proc/self"); statErr == nil {
+		// there is a proc filesystem, the process is gone
+		return nil, err
+	}
+	// no proc filesystem, e.g. on macOS, smithy's paths don't contain spaces
+	out, err := exec.Command("ps", "-o", "command=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+func isFinished(err error) bool {
+	return err == os.ErrProcessDone || err == syscall.ESRCH
+}
+
+// freePort asks the kernel for an unused tcp port on the loopback interface
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("unable to allocate port, %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}